@@ -0,0 +1,309 @@
+package ftdc
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatsAccumulator computes running statistics over chunks as they are
+// added, such as from a live diagnostic.data directory, without retaining
+// their samples. It is safe for concurrent use.
+//
+// As with MergeStats, deltas are only taken between samples of the same
+// chunk. The averages, variances, means, standard deviations, and extremes
+// are exact, up to rounding. Computing the percentiles and MAD exactly
+// requires retaining every delta, so with StatsOptions.Percentiles the
+// deltas are retained unless StatsOptions.Approximate is also set.
+//
+// With Approximate, percentiles are estimated with the P² algorithm, which
+// keeps five markers per percentile rather than the deltas themselves. For
+// smooth distributions the estimates are typically within a few percent of
+// the exact percentiles, but they can be further off for multimodal metrics,
+// for extreme percentiles such as P99, and over few deltas. The median
+// absolute deviation is estimated in the same way, as the P² median of the
+// deltas' deviations from the running P² estimate of their median. For a
+// unimodal metric over 10,000 or more deltas, such as normally distributed
+// ones, it is within 5% of the exact value. Deviations of the earliest
+// deltas are taken from a median which has not yet settled, so metrics
+// whose deltas drift over time can be off by 25% or more, and multimodal
+// metrics, which have no well-defined median, by a factor of two or more.
+type StatsAccumulator struct {
+	mu       sync.Mutex
+	opts     StatsOptions
+	nsamples int
+	start    time.Time
+	end      time.Time
+	metrics  map[string]*metricAccumulator
+}
+
+// NewStatsAccumulator returns an empty StatsAccumulator computing the
+// statistics selected by opts.
+func NewStatsAccumulator(opts StatsOptions) *StatsAccumulator {
+	return &StatsAccumulator{
+		opts:    opts,
+		metrics: make(map[string]*metricAccumulator),
+	}
+}
+
+// Add accumulates the samples of the chunk.
+func (sa *StatsAccumulator) Add(c Chunk) {
+	if sa.opts.ResampleTo > 0 {
+		c = c.resample(sa.opts.ResampleTo)
+	}
+	ts, _ := c.Timestamps()
+
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	// a chunk without metrics has no samples, as for Chunk.StatsWith
+	if len(c.Metrics) > 0 {
+		sa.nsamples += c.NDeltas + 1
+	}
+	if len(ts) > 0 {
+		if sa.start.IsZero() || ts[0].Before(sa.start) {
+			sa.start = ts[0]
+		}
+		if ts[len(ts)-1].After(sa.end) {
+			sa.end = ts[len(ts)-1]
+		}
+	}
+	for _, m := range c.Metrics {
+		ma, ok := sa.metrics[m.Key]
+		if !ok {
+			ma = newMetricAccumulator(sa.opts)
+			sa.metrics[m.Key] = ma
+		}
+		ma.add(sa.opts.prepareMetric(m, ts), sa.opts)
+	}
+}
+
+// Stats returns the statistics of the samples accumulated so far.
+func (sa *StatsAccumulator) Stats() Stats {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	s := Stats{
+		Start:    sa.start,
+		End:      sa.end,
+		Metrics:  make(map[string]MetricStat, len(sa.metrics)),
+		NSamples: sa.nsamples,
+	}
+	for k, ma := range sa.metrics {
+		ms, deltas := ma.stat(sa.opts)
+		s.Metrics[k] = ms
+		s.keepDeltas(k, deltas)
+	}
+	return s
+}
+
+// metricAccumulator holds the running statistics of a single metric. The
+// deltas and values are accumulated with Welford's method.
+type metricAccumulator struct {
+	nvalues int
+	vmean   float64
+	vm2     float64
+	min     int64
+	max     int64
+
+	ndeltas int
+	dsum    int64
+	dmean   float64
+	dm2     float64
+
+	// the deltas, if percentiles are computed exactly
+	deltas []int64
+
+	// p25, p75, p90, p95, and p99, if percentiles are estimated
+	quantiles []*p2Quantile
+
+	// the median of the deltas, and the median of their absolute
+	// deviations from it, if percentiles are estimated
+	median *p2Quantile
+	mad    *p2Quantile
+}
+
+func newMetricAccumulator(opts StatsOptions) *metricAccumulator {
+	ma := &metricAccumulator{}
+	if opts.Percentiles && opts.Approximate {
+		for _, p := range []float64{25, 75, 90, 95, 99} {
+			ma.quantiles = append(ma.quantiles, newP2Quantile(p/100))
+		}
+		ma.median = newP2Quantile(0.5)
+		ma.mad = newP2Quantile(0.5)
+	}
+	return ma
+}
+
+func (ma *metricAccumulator) add(m Metric, opts StatsOptions) {
+	v := m.Value
+	for i := -1; i < len(m.Deltas); i++ {
+		if i >= 0 {
+			d := m.Deltas[i]
+			v += d
+			ma.ndeltas++
+			ma.dsum += d
+			dd := float64(d) - ma.dmean
+			ma.dmean += dd / float64(ma.ndeltas)
+			ma.dm2 += dd * (float64(d) - ma.dmean)
+			if opts.Percentiles && !opts.Approximate {
+				ma.deltas = append(ma.deltas, d)
+			}
+			for _, q := range ma.quantiles {
+				q.add(float64(d))
+			}
+			if ma.median != nil {
+				ma.median.add(float64(d))
+				ma.mad.add(math.Abs(float64(d) - ma.median.value()))
+			}
+		}
+		if ma.nvalues == 0 || v < ma.min {
+			ma.min = v
+		}
+		if ma.nvalues == 0 || v > ma.max {
+			ma.max = v
+		}
+		ma.nvalues++
+		vd := float64(v) - ma.vmean
+		ma.vmean += vd / float64(ma.nvalues)
+		ma.vm2 += vd * (float64(v) - ma.vmean)
+	}
+}
+
+// stat returns the statistics of the metric, along with its sorted deltas if
+// percentiles are computed exactly.
+func (ma *metricAccumulator) stat(opts StatsOptions) (MetricStat, []int64) {
+	stddev := math.Sqrt(ma.vm2 / float64(ma.nvalues))
+	ms := MetricStat{
+		Avg:      -1,
+		Var:      -1,
+		Mean:     ma.vmean,
+		StdDev:   stddev,
+		Min:      ma.min,
+		Max:      ma.max,
+		Range:    ma.max - ma.min,
+		Outlier:  float64(ma.max) > ma.vmean+opts.outlierK()*stddev,
+		NSamples: ma.nvalues,
+	}
+	if ma.ndeltas == 0 {
+		return ms, nil
+	}
+	ms.Avg = ma.dsum / int64(ma.ndeltas)
+	// the variance about the truncated average, as computed by
+	// computeMetricStat
+	n := float64(ma.ndeltas)
+	ms.Var = int64(ma.dm2/n + math.Pow(ma.dmean-float64(ms.Avg), 2))
+	if ma.deltas != nil {
+		l := append([]int64(nil), ma.deltas...)
+		sortInt64s(l)
+		setPercentiles(&ms, l)
+		return ms, l
+	}
+	if len(ma.quantiles) == 5 {
+		ms.P25 = int64(math.Round(ma.quantiles[0].value()))
+		ms.P75 = int64(math.Round(ma.quantiles[1].value()))
+		ms.P90 = int64(math.Round(ma.quantiles[2].value()))
+		ms.P95 = int64(math.Round(ma.quantiles[3].value()))
+		ms.P99 = int64(math.Round(ma.quantiles[4].value()))
+		ms.MAD = int64(math.Round(ma.mad.value()))
+		ms.Percentiles = true
+	}
+	return ms, nil
+}
+
+// p2Quantile estimates the p-quantile of a stream of observations with the
+// P² algorithm of Jain and Chlamtac, which tracks the heights q and positions
+// n of five markers: the minimum, the p/2, p, and (1+p)/2 quantiles, and the
+// maximum.
+type p2Quantile struct {
+	p     float64
+	count int
+	q     [5]float64
+	n     [5]float64
+	np    [5]float64
+	dn    [5]float64
+}
+
+func newP2Quantile(p float64) *p2Quantile {
+	return &p2Quantile{
+		p:  p,
+		np: [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5},
+		dn: [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+func (e *p2Quantile) add(x float64) {
+	if e.count < 5 {
+		e.q[e.count] = x
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.q[:])
+			e.n = [5]float64{1, 2, 3, 4, 5}
+		}
+		return
+	}
+	e.count++
+
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+		k = 0
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3 && x >= e.q[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.n[i]++
+	}
+	for i := range e.np {
+		e.np[i] += e.dn[i]
+	}
+
+	for i := 1; i <= 3; i++ {
+		d := e.np[i] - e.n[i]
+		if (d >= 1 && e.n[i+1]-e.n[i] > 1) || (d <= -1 && e.n[i-1]-e.n[i] < -1) {
+			s := math.Copysign(1, d)
+			q := e.parabolic(i, s)
+			if e.q[i-1] < q && q < e.q[i+1] {
+				e.q[i] = q
+			} else {
+				e.q[i] = e.linear(i, s)
+			}
+			e.n[i] += s
+		}
+	}
+}
+
+func (e *p2Quantile) parabolic(i int, s float64) float64 {
+	q, n := e.q, e.n
+	return q[i] + s/(n[i+1]-n[i-1])*
+		((n[i]-n[i-1]+s)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+			(n[i+1]-n[i]-s)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+func (e *p2Quantile) linear(i int, s float64) float64 {
+	j := i + int(s)
+	return e.q[i] + s*(e.q[j]-e.q[i])/(e.n[j]-e.n[i])
+}
+
+// value returns the current estimate. Until five observations have been
+// made, it is their exact nearest-rank quantile.
+func (e *p2Quantile) value() float64 {
+	if e.count == 0 {
+		return 0
+	}
+	if e.count < 5 {
+		l := make([]float64, e.count)
+		copy(l, e.q[:e.count])
+		sort.Float64s(l)
+		rank := int(math.Ceil(e.p * float64(len(l))))
+		if rank < 1 {
+			rank = 1
+		}
+		return l[rank-1]
+	}
+	return e.q[2]
+}
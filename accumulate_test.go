@@ -0,0 +1,61 @@
+package ftdc
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestStatsAccumulatorApproximate(t *testing.T) {
+	// normally distributed deltas, in chunks of 300 samples
+	rng := rand.New(rand.NewSource(1))
+	var chunks []Chunk
+	for start := int64(1600000000000); len(chunks) < 100; start += 300000 {
+		c := Chunk{NDeltas: 299, Metrics: []Metric{
+			{Key: "start", Value: start, Deltas: make([]int64, 299)},
+			{Key: "serverStatus.x", Value: 1 << 20, Deltas: make([]int64, 299)},
+		}}
+		for i := 0; i < 299; i++ {
+			c.Metrics[0].Deltas[i] = 1000
+			c.Metrics[1].Deltas[i] = int64(1000 + 100*rng.NormFloat64())
+		}
+		chunks = append(chunks, c)
+	}
+	c := make(chan Chunk, len(chunks))
+	for _, chunk := range chunks {
+		c <- chunk
+	}
+	close(c)
+	exact, err := ComputeStatsStreamWith(c, StatsOptions{Percentiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := exact.Metrics["serverStatus.x"]
+
+	accumulate := func(opts StatsOptions) MetricStat {
+		sa := NewStatsAccumulator(opts)
+		for _, chunk := range chunks {
+			sa.Add(chunk)
+		}
+		if retained := sa.metrics["serverStatus.x"].deltas != nil; retained == opts.Approximate {
+			t.Errorf("approximate %v: got deltas retained %v", opts.Approximate, retained)
+		}
+		ms := sa.Stats().Metrics["serverStatus.x"]
+		if !ms.Percentiles {
+			t.Fatalf("got no percentiles")
+		}
+		return ms
+	}
+
+	got := accumulate(StatsOptions{Percentiles: true})
+	if got.P25 != want.P25 || got.P95 != want.P95 || got.P99 != want.P99 || got.MAD != want.MAD {
+		t.Errorf("got P25 %d, P95 %d, P99 %d, and MAD %d, expected %d, %d, %d, and %d",
+			got.P25, got.P95, got.P99, got.MAD, want.P25, want.P95, want.P99, want.MAD)
+	}
+
+	got = accumulate(StatsOptions{Percentiles: true, Approximate: true})
+	// the bound documented for unimodal metrics over 10,000 or more deltas
+	if rel := math.Abs(float64(got.MAD-want.MAD)) / float64(want.MAD); rel > 0.05 {
+		t.Errorf("got estimated MAD %d, %.1f%% off the exact %d", got.MAD, 100*rel, want.MAD)
+	}
+}
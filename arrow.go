@@ -0,0 +1,57 @@
+//go:build arrow
+
+package ftdc
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+)
+
+// ToArrow converts the chunk to an Arrow record with one row per sample. The
+// first column, 'timestamp', holds the sample times in milliseconds, followed
+// by one Int64 column per metric, ordered as by WriteCSV. The caller must
+// release the record. It is only available when built with the 'arrow' tag.
+func (c *Chunk) ToArrow(pool memory.Allocator) (arrow.Record, error) {
+	ts, err := c.Timestamps()
+	if err != nil {
+		return nil, err
+	}
+	metrics := c.sortedMetrics()
+	fields := make([]arrow.Field, 0, len(metrics)+1)
+	fields = append(fields, arrow.Field{
+		Name: "timestamp",
+		Type: &arrow.TimestampType{Unit: arrow.Millisecond},
+	})
+	for _, m := range metrics {
+		if len(m.Deltas)+1 != len(ts) {
+			return nil, fmt.Errorf("metric '%s' has %d samples, expected %d",
+				m.Key, len(m.Deltas)+1, len(ts))
+		}
+		fields = append(fields, arrow.Field{
+			Name: m.Key,
+			Type: arrow.PrimitiveTypes.Int64,
+		})
+	}
+
+	b := array.NewRecordBuilder(pool, arrow.NewSchema(fields, nil))
+	defer b.Release()
+	tb := b.Field(0).(*array.TimestampBuilder)
+	tb.Reserve(len(ts))
+	for _, t := range ts {
+		tb.Append(arrow.Timestamp(t.UnixNano() / 1e6))
+	}
+	for i, m := range metrics {
+		ib := b.Field(i + 1).(*array.Int64Builder)
+		ib.Reserve(len(ts))
+		v := m.Value
+		ib.Append(v)
+		for _, d := range m.Deltas {
+			v += d
+			ib.Append(v)
+		}
+	}
+	return b.NewRecord(), nil
+}
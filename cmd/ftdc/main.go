@@ -95,10 +95,11 @@ func (expOpts *ExportCommand) Execute(args []string) error {
 }
 
 type StatsCommand struct {
-	StartTime string `long:"start" value-name:"<TIME>" description:"clip data preceding start time (layout UnixDate)"`
-	EndTime   string `long:"end" value-name:"<TIME>" description:"clip data after end time (layout UnixDate)"`
-	Out       string `short:"o" long:"out" value-name:"<FILE>" description:"write stats output, in JSON, to given file" required:"true"`
-	Args      struct {
+	StartTime   string `long:"start" value-name:"<TIME>" description:"clip data preceding start time (layout UnixDate)"`
+	EndTime     string `long:"end" value-name:"<TIME>" description:"clip data after end time (layout UnixDate)"`
+	Out         string `short:"o" long:"out" value-name:"<FILE>" description:"write stats output, in JSON, to given file" required:"true"`
+	Percentiles bool   `short:"p" long:"percentiles" description:"compute quartiles, 90th, 95th, and 99th percentiles, and median absolute deviations of the deltas over all of them at once (buffers every delta)"`
+	Args        struct {
 		Files []string `positional-arg-name:"FILE" description:"diagnostic file(s)"`
 	} `positional-args:"yes" required:"yes"`
 }
@@ -107,7 +108,10 @@ func (statOpts *StatsCommand) Execute(args []string) error {
 	if len(args) > 0 {
 		return fmt.Errorf("unknown argument: %s", args[0])
 	}
-	output, err := stats(statOpts.Args.Files, statOpts.StartTime, statOpts.EndTime)
+	opts := ftdc.StatsOptions{
+		Percentiles: statOpts.Percentiles,
+	}
+	output, err := stats(statOpts.Args.Files, statOpts.StartTime, statOpts.EndTime, opts)
 	if err != nil {
 		return err
 	}
@@ -128,7 +132,6 @@ func (cmp *CompareCommand) Execute(args []string) error {
 	if len(args) > 0 {
 		return fmt.Errorf("unknown argument: %s", args[0])
 	}
-	ftdc.CmpThreshold = cmp.Threshold
 	sa, err := readJSONStats(cmp.Args.FileA)
 	if err != nil {
 		return err
@@ -138,7 +141,9 @@ func (cmp *CompareCommand) Execute(args []string) error {
 		return err
 	}
 
-	score, scores, ok := ftdc.Proximal(sa, sb)
+	score, scores, ok := ftdc.ProximalWith(sa, sb, ftdc.CompareOptions{
+		Threshold: cmp.Threshold,
+	})
 	// score to stdout, scores to stdout, ok to status code
 	sort.Sort(sort.Reverse(scores))
 	var msg string
@@ -199,7 +204,7 @@ func parseTimes(tStart, tEnd string) (start, end time.Time, err error) {
 	return
 }
 
-func stats(files []string, tStart, tEnd string) (interface{}, error) {
+func stats(files []string, tStart, tEnd string, opts ftdc.StatsOptions) (interface{}, error) {
 	if len(files) == 0 {
 		return nil, fmt.Errorf("error: must provide FILE")
 	}
@@ -209,6 +214,12 @@ func stats(files []string, tStart, tEnd string) (interface{}, error) {
 		return nil, err
 	}
 
+	if opts.Percentiles {
+		// percentiles can't be merged from those of each chunk, so they
+		// are computed over the deltas of all chunks at once
+		return statsStream(files, start, end, opts)
+	}
+
 	ss := []ftdc.Stats{}
 	for _, file := range files {
 		f, err := os.Open(file)
@@ -216,7 +227,12 @@ func stats(files []string, tStart, tEnd string) (interface{}, error) {
 			return nil, fmt.Errorf("error: failed to open '%s': %s", file, err)
 		}
 
-		cs, err := ftdc.ComputeStatsInterval(f, start, end)
+		r, err := ftdc.AutoReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("error: failed to read '%s': %s", file, err)
+		}
+
+		cs, err := ftdc.ComputeStatsIntervalWith(r, start, end, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -233,6 +249,56 @@ func stats(files []string, tStart, tEnd string) (interface{}, error) {
 	return ms, nil
 }
 
+// statsStream computes the statistics of the chunks of files within the
+// given interval in a single pass with ComputeStatsStreamWith, which
+// buffers the deltas of each metric across all files.
+func statsStream(files []string, start, end time.Time, opts ftdc.StatsOptions) (interface{}, error) {
+	o := make(chan ftdc.Chunk)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(o)
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				errc <- fmt.Errorf("error: failed to open '%s': %s", file, err)
+				return
+			}
+
+			r, err := ftdc.AutoReader(f)
+			if err != nil {
+				f.Close()
+				errc <- fmt.Errorf("error: failed to read '%s': %s", file, err)
+				return
+			}
+
+			cr := ftdc.NewChunkReader(r)
+			for cr.Next() {
+				c := cr.Chunk()
+				if c.Clip(start, end) {
+					o <- c
+				}
+			}
+			f.Close()
+			if err := cr.Err(); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	ms, err := ftdc.ComputeStatsStreamWith(o, opts)
+	if rerr := <-errc; rerr != nil {
+		return nil, rerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no chunks found")
+	}
+	fmt.Fprintf(os.Stderr, "found %d samples\n", ms.NSamples)
+
+	return ms, nil
+}
+
 func decode(files []string, tStart, tEnd string, silent, shouldMerge bool) (interface{}, error) {
 	if len(files) == 0 {
 		return nil, fmt.Errorf("error: must provide FILE")
@@ -254,7 +320,7 @@ func decode(files []string, tStart, tEnd string, silent, shouldMerge bool) (inte
 
 		o := make(chan ftdc.Chunk)
 		go func() {
-			err := ftdc.Chunks(f, o)
+			err := ftdc.ChunksAuto(f, o)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error: failed to parse chunks: %s\n", err)
 			}
@@ -294,7 +360,7 @@ func decode(files []string, tStart, tEnd string, silent, shouldMerge bool) (inte
 				k := m.Key
 				if _, ok := total[k]; ok {
 					// !! this expects contigious chunks
-					newDeltas := make([]int, 0, len(total[k].Deltas)+len(m.Deltas))
+					newDeltas := make([]int64, 0, len(total[k].Deltas)+len(m.Deltas))
 					newDeltas = append(newDeltas, total[k].Deltas...)
 					newDeltas = append(newDeltas, m.Deltas...)
 					total[k] = ftdc.Metric{
@@ -336,7 +402,7 @@ func export(files []string, tStart string, tEnd string, silent bool, out io.Writ
 
 		o := make(chan ftdc.Chunk)
 		go func() {
-			err := ftdc.Chunks(f, o)
+			err := ftdc.ChunksAuto(f, o)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error: failed to parse chunks: %s\n", err)
 			}
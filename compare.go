@@ -3,12 +3,17 @@ package ftdc
 import (
 	"fmt"
 	"math"
+	"path"
 	"sort"
 	"strings"
+	"time"
 )
 
 // CmpThreshold is the threshold for comparison of metrics used by the
-// Proximal function.
+// Proximal function, and by ProximalWith when CompareOptions.Threshold is
+// not set. Comparisons which need different thresholds, particularly
+// concurrent ones, should set CompareOptions.Threshold rather than modify
+// CmpThreshold.
 var CmpThreshold float64 = 0.2
 
 var cmpMetrics = map[string]bool{
@@ -46,6 +51,224 @@ var cmpMetrics = map[string]bool{
 
 const badTimePenalty = -0.1
 
+// CompareOptions configures the comparison performed by ProximalWith.
+type CompareOptions struct {
+	// Include is the list of metric key prefixes to compare. A prefix matches
+	// a key equal to it or any key nested beneath it, and may be a pattern
+	// such as 'serverStatus.*.insert', where each dot-delimited component is
+	// matched as by path.Match, so a '*' never spans a '.'. If nil, the
+	// default set of metrics used by Proximal is compared.
+	Include []string
+
+	// Exclude is a list of metric key prefixes or patterns, as in Include,
+	// which are not compared, even if they are matched by Include.
+	Exclude []string
+
+	// Threshold overrides CmpThreshold when non-zero.
+	Threshold float64
+
+	// Weights scales the contribution of metrics to the aggregated score. A
+	// metric is weighted by the entry for its longest matching key prefix,
+	// or 1 if none match; the sample count comparison uses the key
+	// "NSamples". Weights are normalized along with the positional weights,
+	// so a perfect comparison still scores 1.0.
+	Weights map[string]float64
+
+	// Direction gives the direction in which deviations of a metric's
+	// average are penalized, with the first Stats of the comparison taken as
+	// the baseline. A metric uses the entry for its longest matching key
+	// prefix, or TwoSided if none match. Variances are always compared
+	// two-sided.
+	Direction map[string]CompareDirection
+
+	// SkipNSamples disables the comparison of sample counts.
+	SkipNSamples bool
+
+	// NSamplesPenalty overrides the penalty, which should be negative,
+	// bounding the sample count score: the score is one less the relative
+	// difference of the sample counts, but no lower than one plus twice the
+	// penalty. If zero, the default of -0.1 is used.
+	NSamplesPenalty float64
+
+	// Spread computes the statistic used to compare the spread of each
+	// metric's deltas. If nil, VarSpread is used.
+	Spread SpreadFunc
+
+	// Tail also compares the P95 and P99 of each metric's deltas, catching
+	// regressions which shift the tail of a metric while leaving its average
+	// flat. Each percentile contributes to the metric's score as the average
+	// does, and follows opts.Direction. It requires the Stats to be computed
+	// with StatsOptions.Percentiles.
+	Tail bool
+
+	// TailThreshold overrides the threshold for the percentiles compared by
+	// Tail when non-zero.
+	TailThreshold float64
+
+	// MinAvg drops from the comparison the metrics whose averages are below
+	// it in magnitude in both Stats, such as counters of features which are
+	// unused, so that they do not dilute the score of the metrics which
+	// changed. Metrics without deltas in either Stats are not dropped.
+	MinAvg int64
+
+	// WarnThreshold and CriticalThreshold are the thresholds below which the
+	// score of a report gives it a Severity of SeverityWarning and
+	// SeverityCritical, respectively. Either defaults to the threshold of the
+	// comparison when zero, so that by default a report is SeverityCritical
+	// exactly when it is not OK. Setting WarnThreshold below the threshold
+	// warns of drift within it, and setting CriticalThreshold above it only
+	// treats the further misses as critical.
+	WarnThreshold     float64
+	CriticalThreshold float64
+}
+
+// SpreadFunc computes a measure of the spread of a metric's deltas from its
+// statistics.
+type SpreadFunc func(MetricStat) float64
+
+// VarSpread measures spread by the variance. It is the default SpreadFunc.
+func VarSpread(s MetricStat) float64 {
+	return float64(s.Var)
+}
+
+// IQRSpread measures spread by the interquartile range, which is robust to
+// outliers in heavy-tailed metrics. It requires the Stats to be computed with
+// StatsOptions.Percentiles; for a metric without percentiles, it falls back
+// to the variance, as VarSpread does.
+func IQRSpread(s MetricStat) float64 {
+	if !hasPercentiles(s) {
+		return VarSpread(s)
+	}
+	return float64(s.P75 - s.P25)
+}
+
+// MADSpread measures spread by the median absolute deviation of the deltas,
+// which is robust to outliers and, unlike the interquartile range, to
+// skewed distributions of deltas. It requires the Stats to be computed with
+// StatsOptions.Percentiles; for a metric without percentiles, it falls back
+// to the variance, as VarSpread does.
+func MADSpread(s MetricStat) float64 {
+	if !hasPercentiles(s) {
+		return VarSpread(s)
+	}
+	return float64(s.MAD)
+}
+
+// CVSpread measures spread by the coefficient of variation: the standard
+// deviation relative to the magnitude of the average. If the average is 0,
+// the standard deviation is used.
+func CVSpread(s MetricStat) float64 {
+	stddev := math.Sqrt(float64(s.Var))
+	if s.Avg == 0 {
+		return stddev
+	}
+	return stddev / math.Abs(float64(s.Avg))
+}
+
+// CompareDirection specifies which deviations of a metric from the baseline
+// are penalized by a comparison.
+type CompareDirection int
+
+const (
+	// TwoSided penalizes deviations in either direction.
+	TwoSided CompareDirection = iota
+
+	// HigherIsBetter only penalizes values below the baseline.
+	HigherIsBetter
+
+	// LowerIsBetter only penalizes values above the baseline.
+	LowerIsBetter
+)
+
+func (opts CompareOptions) weight(key string) float64 {
+	s := strings.Split(key, ".")
+	for i := len(s); i > 0; i-- {
+		if w, ok := opts.Weights[strings.Join(s[:i], ".")]; ok {
+			return w
+		}
+	}
+	return 1
+}
+
+func (opts CompareOptions) direction(key string) CompareDirection {
+	s := strings.Split(key, ".")
+	for i := len(s); i > 0; i-- {
+		if d, ok := opts.Direction[strings.Join(s[:i], ".")]; ok {
+			return d
+		}
+	}
+	return TwoSided
+}
+
+func (opts CompareOptions) nsamplesPenalty() float64 {
+	if opts.NSamplesPenalty != 0 {
+		return opts.NSamplesPenalty
+	}
+	return badTimePenalty
+}
+
+func (opts CompareOptions) threshold() float64 {
+	if opts.Threshold != 0 {
+		return opts.Threshold
+	}
+	return CmpThreshold
+}
+
+func (opts CompareOptions) tailThreshold() float64 {
+	if opts.TailThreshold != 0 {
+		return opts.TailThreshold
+	}
+	return opts.threshold()
+}
+
+// Severity categorizes the result of a comparison by how far its score falls
+// below the thresholds of CompareOptions.
+type Severity int
+
+// The severities of ProximalReport.Severity, from least to most severe.
+const (
+	// SeverityOK is a score within the warning threshold.
+	SeverityOK Severity = iota
+
+	// SeverityWarning is a score below the warning threshold, but within the
+	// critical one.
+	SeverityWarning
+
+	// SeverityCritical is a score below the critical threshold.
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityOK:
+		return "ok"
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// severity returns the severity of a score compared with the given
+// threshold.
+func (opts CompareOptions) severity(score, threshold float64) Severity {
+	warn, crit := opts.WarnThreshold, opts.CriticalThreshold
+	if warn == 0 {
+		warn = threshold
+	}
+	if crit == 0 {
+		crit = threshold
+	}
+	switch {
+	case score < 1-crit:
+		return SeverityCritical
+	case score < 1-warn:
+		return SeverityWarning
+	}
+	return SeverityOK
+}
+
 // CmpScore holds information for the comparison of a single metric.
 type CmpScore struct {
 	// Metric is the name of the metric being compared
@@ -71,17 +294,128 @@ func (s CmpScores) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
-func isCmpMetric(key string) bool {
+func isCmpMetric(key string, include, exclude keySet) bool {
+	return hasKeyPrefix(key, include) && !hasKeyPrefix(key, exclude)
+}
+
+// keySet is a set of metric key patterns, as selected by CompareOptions.Include
+// and ChunksFiltered. A pattern matches a key if it is equal to the key or any
+// of its dot-delimited prefixes, or if it has the syntax of path.Match and
+// matches them component by component. A '*' thus matches within a single
+// component and never spans a '.': 'serverStatus.*.insert' matches
+// 'serverStatus.opcounters.insert' but not 'serverStatus.a.b.insert', while
+// 'serverStatus.wiredTiger.*' matches every metric nested beneath
+// 'serverStatus.wiredTiger'. Malformed patterns match nothing.
+type keySet struct {
+	prefixes map[string]bool
+	globs    [][]string // components of the patterns with metacharacters
+}
+
+// hasKeyPrefix returns whether key, or any dot-delimited prefix of key, is
+// matched by the set.
+func hasKeyPrefix(key string, set keySet) bool {
 	s := strings.Split(key, ".")
 	for i := range s {
 		prefix := strings.Join(s[:i+1], ".")
-		if _, ok := cmpMetrics[prefix]; ok {
+		if _, ok := set.prefixes[prefix]; ok {
+			return true
+		}
+	}
+	for _, g := range set.globs {
+		if len(g) <= len(s) && matchComponents(g, s[:len(g)]) {
 			return true
 		}
 	}
 	return false
 }
 
+func matchComponents(pattern, key []string) bool {
+	for i := range pattern {
+		ok, err := path.Match(pattern[i], key[i])
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func prefixSet(prefixes []string) keySet {
+	set := keySet{prefixes: make(map[string]bool, len(prefixes))}
+	for _, p := range prefixes {
+		if isKeyPattern(p) {
+			set.globs = append(set.globs, strings.Split(p, "."))
+		} else {
+			set.prefixes[p] = true
+		}
+	}
+	return set
+}
+
+// isKeyPattern returns whether p has any of the metacharacters of path.Match.
+func isKeyPattern(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// checkKeyPatterns returns an error for the first of the patterns which is
+// malformed.
+func checkKeyPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if !isKeyPattern(p) {
+			continue
+		}
+		for _, c := range strings.Split(p, ".") {
+			if _, err := path.Match(c, ""); err != nil {
+				return fmt.Errorf("invalid key pattern '%s': %s", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ProximalReport holds the detailed result of a comparison.
+type ProximalReport struct {
+	// Score is the numeric rating of the comparison (1.0 = perfect). It
+	// does not depend on the threshold, so scores of comparisons made with
+	// different thresholds can be compared.
+	Score float64
+
+	// OK is whether the threshold was met
+	OK bool
+
+	// Severity categorizes the score by the warning and critical thresholds
+	// of CompareOptions
+	Severity Severity
+
+	// Scores is the sorted list of scores for all compared metrics
+	Scores CmpScores
+
+	// NSamplesMiss is whether the sample counts were not within the
+	// threshold
+	NSamplesMiss bool
+
+	// Misses lists the compared metrics which were not within the threshold
+	Misses []MetricMiss
+}
+
+// MetricMiss describes a metric which was not within the threshold of a
+// comparison.
+type MetricMiss struct {
+	// Key is the key of the metric
+	Key string
+
+	// A and B are the statistics of the metric in each of the compared Stats
+	A, B MetricStat
+
+	// AvgMiss and VarMiss are whether the averages and spreads (by default,
+	// variances), respectively, were not within the threshold
+	AvgMiss bool
+	VarMiss bool
+
+	// TailMiss is whether the P95 or P99 were not within the tail threshold,
+	// if compared with CompareOptions.Tail
+	TailMiss bool
+}
+
 // Proximal computes a measure of deviation between two sets of metric
 // statistics. It computes an aggregated score based on compareMetrics
 // output, and compares it against the CmpThreshold.
@@ -90,85 +424,465 @@ func isCmpMetric(key string) bool {
 // the sorted list of scores for all compared metrics, and ok is whether the
 // threshold was met.
 func Proximal(a, b Stats) (score float64, scores CmpScores, ok bool) {
-	aCount := float64(a.NSamples)
-	bCount := float64(b.NSamples)
-	diff := math.Abs(aCount - bCount)
-	max := math.Max(aCount, bCount)
-	nsampleScore := CmpScore{
-		Metric: "NSamples",
-		Score:  1,
-	}
-	if diff/max > CmpThreshold {
-		nsampleScore.Score = 1 + 2*badTimePenalty // doubled for expected impact
-		nsampleScore.Err = fmt.Errorf("sample count not proximal: (%d, %d) "+
-			"are not within threshold (%d%%)\n",
-			a.NSamples, b.NSamples, int(CmpThreshold*100))
-	}
-
-	scores = make(CmpScores, 0)
-	scores = append(scores, nsampleScore)
-	var sumScores float64
+	return ProximalWith(a, b, CompareOptions{})
+}
+
+// ProximalWith is like Proximal, but compares the metrics and uses the
+// threshold given by opts.
+func ProximalWith(a, b Stats, opts CompareOptions) (score float64, scores CmpScores, ok bool) {
+	r := ProximalDetailedWith(a, b, opts)
+	return r.Score, r.Scores, r.OK
+}
+
+// ProximalDetailed is like Proximal, but returns a ProximalReport describing
+// which metrics were not within the threshold.
+func ProximalDetailed(a, b Stats) ProximalReport {
+	return ProximalDetailedWith(a, b, CompareOptions{})
+}
+
+// ProximalDetailedWith is like ProximalDetailed, but compares the metrics and
+// uses the threshold given by opts.
+func ProximalDetailedWith(a, b Stats, opts CompareOptions) (r ProximalReport) {
+	threshold := opts.threshold()
+	include := keySet{prefixes: cmpMetrics}
+	if opts.Include != nil {
+		include = prefixSet(opts.Include)
+	}
+	exclude := prefixSet(opts.Exclude)
+
+	r.Scores = make(CmpScores, 0)
+	if !opts.SkipNSamples {
+		aCount := float64(a.NSamples)
+		bCount := float64(b.NSamples)
+		diff := math.Abs(aCount - bCount)
+		max := math.Max(aCount, bCount)
+		nsampleScore := CmpScore{
+			Metric: "NSamples",
+			Score:  1,
+		}
+		if max > 0 {
+			// one less the relative difference, floored at the penalty,
+			// doubled for expected impact
+			nsampleScore.Score = math.Max(1-diff/max, 1+2*opts.nsamplesPenalty())
+		}
+		if max > 0 && diff/max > threshold {
+			r.NSamplesMiss = true
+			nsampleScore.Err = fmt.Errorf("sample count not proximal: (%d, %d) "+
+				"are not within threshold (%d%%)\n",
+				a.NSamples, b.NSamples, int(threshold*100))
+		}
+		r.Scores = append(r.Scores, nsampleScore)
+	}
 	for key := range a.Metrics {
 		if _, ok := b.Metrics[key]; !ok {
 			continue
 		}
-		if !isCmpMetric(key) {
+		if !isCmpMetric(key, include, exclude) {
+			continue
+		}
+		if belowMinAvg(a.Metrics[key], b.Metrics[key], opts.MinAvg) {
+			continue
+		}
+		cmp, miss := compareMetrics(a, b, key, opts)
+		r.Scores = append(r.Scores, cmp)
+		if miss != nil {
+			r.Misses = append(r.Misses, *miss)
+		}
+	}
+	r.aggregate(opts, threshold)
+	return
+}
+
+// SelfDrift compares the samples of the chunks before the split time against
+// those from the split time on with ProximalDetailed, such as to find slow
+// drift within a single long capture that statistics of the whole capture
+// average away. As the two sides need not hold as many samples, sample counts
+// are not compared. It returns an error if either side has no samples.
+func SelfDrift(chunks []Chunk, split time.Time) (ProximalReport, error) {
+	return SelfDriftWith(chunks, split, CompareOptions{SkipNSamples: true})
+}
+
+// SelfDriftWith is like SelfDrift, but compares using ProximalDetailedWith
+// with the given opts.
+func SelfDriftWith(chunks []Chunk, split time.Time, opts CompareOptions) (ProximalReport, error) {
+	var before, after []Stats
+	for i := range chunks {
+		c := &chunks[i]
+		ts, err := c.Timestamps()
+		if err != nil {
+			return ProximalReport{}, err
+		}
+		n := sort.Search(len(ts), func(j int) bool { return !ts[j].Before(split) })
+		if n > 0 {
+			part := c.ClipSamples(0, n)
+			before = append(before, part.Stats())
+		}
+		if n < len(ts) {
+			part := c.ClipSamples(n, len(ts))
+			after = append(after, part.Stats())
+		}
+	}
+	if len(before) == 0 || len(after) == 0 {
+		return ProximalReport{}, fmt.Errorf("no samples on both sides of %s",
+			split.UTC().Format(time.RFC3339Nano))
+	}
+	return ProximalDetailedWith(MergeStats(before...), MergeStats(after...), opts), nil
+}
+
+// RankedResult holds the result of comparing a named candidate against a
+// baseline with ProximalMulti.
+type RankedResult struct {
+	Name  string
+	Score float64
+	OK    bool
+}
+
+// ProximalMulti compares each of the candidates against the baseline with
+// Proximal. The results are sorted by score, descending, with ties ordered by
+// name.
+func ProximalMulti(baseline Stats, candidates map[string]Stats) []RankedResult {
+	return ProximalMultiWith(baseline, candidates, CompareOptions{})
+}
+
+// ProximalMultiWith is like ProximalMulti, but compares using ProximalWith
+// with the given opts.
+func ProximalMultiWith(baseline Stats, candidates map[string]Stats, opts CompareOptions) []RankedResult {
+	results := make([]RankedResult, 0, len(candidates))
+	for name, s := range candidates {
+		score, _, ok := ProximalWith(baseline, s, opts)
+		results = append(results, RankedResult{
+			Name:  name,
+			Score: score,
+			OK:    ok,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// CompareToReference compares the average of each metric in ref against the
+// average of the same metric in s, flagging metrics whose relative difference
+// exceeds tolerance, with averages of opposite sign differing by 1 as in
+// ProximalDetailed. Metrics of ref which are missing from s are flagged with
+// a score of 0, while those present without deltas, such as in a single
+// sample, are skipped. The report is scored in the same way as
+// ProximalDetailed.
+func CompareToReference(s Stats, ref map[string]int64, tolerance float64) (r ProximalReport) {
+	r.Scores = make(CmpScores, 0, len(ref))
+	for key, v := range ref {
+		cmp := CmpScore{
+			Metric: key,
+			Score:  1,
+		}
+		stat, ok := s.Metrics[key]
+		if !ok {
+			cmp.Score = 0
+			cmp.Err = fmt.Errorf("metric '%s' not present\n", key)
+			r.Scores = append(r.Scores, cmp)
+			r.Misses = append(r.Misses, MetricMiss{
+				Key:     key,
+				B:       MetricStat{Avg: v},
+				AvgMiss: true,
+			})
+			continue
+		}
+		if stat.Var < 0 {
+			continue // no deltas to compare
+		}
+		rel := relDiff(v, stat.Avg, TwoSided)
+		cmp.Score = 1 - rel
+		if rel > tolerance {
+			cmp.Err = fmt.Errorf("metric '%s' not proximal: "+
+				"average %d is not within threshold (%d%%) of reference %d\n",
+				key, stat.Avg, int(tolerance*100), v)
+			r.Misses = append(r.Misses, MetricMiss{
+				Key:     key,
+				A:       stat,
+				B:       MetricStat{Avg: v},
+				AvgMiss: true,
+			})
+		}
+		r.Scores = append(r.Scores, cmp)
+	}
+	r.aggregate(CompareOptions{}, tolerance)
+	return
+}
+
+// P99Regressions returns the metrics, sorted by key, whose P99 delta in the
+// candidate exceeds that in the baseline by more than pct percent of the
+// baseline's magnitude, as a quick gate on tail latency. If the baseline's
+// P99 is 0, any increase is a regression. Metrics without deltas in either
+// Stats are skipped. It requires the Stats to be computed with
+// StatsOptions.Percentiles. The misses have TailMiss set.
+func P99Regressions(baseline, candidate Stats, pct float64) []MetricMiss {
+	var misses []MetricMiss
+	for key, a := range baseline.Metrics {
+		b, ok := candidate.Metrics[key]
+		if !ok || a.Var < 0 || b.Var < 0 || b.P99 <= a.P99 {
+			continue
+		}
+		growth := math.Abs(float64(b.P99-a.P99)) / math.Abs(float64(a.P99))
+		if a.P99 != 0 && growth <= pct/100 {
+			continue
+		}
+		misses = append(misses, MetricMiss{
+			Key:      key,
+			A:        a,
+			B:        b,
+			TailMiss: true,
+		})
+	}
+	sort.Slice(misses, func(i, j int) bool {
+		return misses[i].Key < misses[j].Key
+	})
+	return misses
+}
+
+// DiffKeys returns the sorted keys of the metrics present only in a, only in
+// b, and in both, such as to see which metrics a comparison of captures from
+// different server versions skips.
+func DiffKeys(a, b Stats) (onlyA, onlyB, common []string) {
+	for key := range a.Metrics {
+		if _, ok := b.Metrics[key]; ok {
+			common = append(common, key)
+		} else {
+			onlyA = append(onlyA, key)
+		}
+	}
+	for key := range b.Metrics {
+		if _, ok := a.Metrics[key]; !ok {
+			onlyB = append(onlyB, key)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	sort.Strings(common)
+	return
+}
+
+// RatioTable returns the ratio of the candidate's average to the baseline's
+// for each metric compared by Proximal which has deltas in both. If both
+// averages are 0 the ratio is 1, and if only the baseline's is 0 it is
+// positive or negative infinity, following the sign of the candidate's.
+func RatioTable(baseline, candidate Stats) map[string]float64 {
+	return RatioTableWith(baseline, candidate, CompareOptions{})
+}
+
+// RatioTableWith is like RatioTable, but selects the metrics using the
+// Include and Exclude fields of opts.
+func RatioTableWith(baseline, candidate Stats, opts CompareOptions) map[string]float64 {
+	include := keySet{prefixes: cmpMetrics}
+	if opts.Include != nil {
+		include = prefixSet(opts.Include)
+	}
+	exclude := prefixSet(opts.Exclude)
+
+	t := make(map[string]float64)
+	for key, a := range baseline.Metrics {
+		b, ok := candidate.Metrics[key]
+		if !ok || a.Var < 0 || b.Var < 0 || !isCmpMetric(key, include, exclude) {
 			continue
 		}
-		cmp := compareMetrics(a, b, key)
-		scores = append(scores, cmp)
-		sumScores += cmp.Score
+		switch {
+		case a.Avg == b.Avg:
+			t[key] = 1
+		case a.Avg == 0 && b.Avg > 0:
+			t[key] = math.Inf(1)
+		case a.Avg == 0:
+			// the averages differ, so the candidate's is negative
+			t[key] = math.Inf(-1)
+		default:
+			t[key] = float64(b.Avg) / float64(a.Avg)
+		}
+	}
+	return t
+}
+
+// Ratio is an entry of a ratio table.
+type Ratio struct {
+	Key   string
+	Ratio float64
+}
+
+// SortRatios returns the entries of a ratio table ordered by how far they
+// deviate from 1, largest first, so the greatest changes in either direction
+// come first. A ratio of 2 deviates as much as one of 0.5, and a ratio which
+// is not positive, from a change of sign, deviates more than any other.
+func SortRatios(t map[string]float64) []Ratio {
+	rs := make([]Ratio, 0, len(t))
+	for k, v := range t {
+		rs = append(rs, Ratio{Key: k, Ratio: v})
+	}
+	dev := func(r float64) float64 {
+		if r <= 0 {
+			return math.Inf(1)
+		}
+		return math.Abs(math.Log(r))
 	}
-	sort.Sort(scores)
+	sort.Slice(rs, func(i, j int) bool {
+		di, dj := dev(rs[i].Ratio), dev(rs[j].Ratio)
+		if di != dj {
+			return di > dj
+		}
+		return rs[i].Key < rs[j].Key
+	})
+	return rs
+}
+
+// aggregate sorts the report's scores and misses, and computes its overall
+// score and whether it meets the threshold.
+func (r *ProximalReport) aggregate(opts CompareOptions, threshold float64) {
+	sort.Sort(r.Scores)
+	sort.Slice(r.Misses, func(i, j int) bool {
+		return r.Misses[i].Key < r.Misses[j].Key
+	})
 
 	// weighted sum of 1/2, 1/4, 1/8, ...
-	// with scores from worst to best
-	for i, c := range scores {
-		score += math.Pow(2, -float64(i+1)) * c.Score
+	// with scores from worst to best, scaled by the metric weights and
+	// normalized by the total weight
+	var total float64
+	r.Score = 0
+	for i, c := range r.Scores {
+		w := math.Pow(2, -float64(i+1)) * opts.weight(c.Metric)
+		r.Score += w * c.Score
+		total += w
+	}
+	if total > 0 {
+		r.Score /= total
+	} else {
+		r.Score = 1
 	}
 	// score is quadratic, so sqrt for linear
-	score = math.Sqrt(score)
+	r.Score = math.Sqrt(r.Score)
 
-	ok = score >= (1 - CmpThreshold)
-	return
+	r.OK = r.Score >= (1 - threshold)
+	r.Severity = opts.severity(r.Score, threshold)
 }
 
 // compareMetrics computes a measure of deviation between two samples of the
 // same metric. It computes a score of (1 - rx')*(1 - rx''), where rx' and
 // rx'' correspond to the relative difference of the first and second
-// derivatives of the time-series metric.
-func compareMetrics(sa, sb Stats, key string) (score CmpScore) {
+// derivatives of the time-series metric, the latter measured by opts.Spread.
+// Averages of opposite sign have a relative difference of 1, and spreads
+// which are both 0 have none. A difference of
+// the averages in the direction favored by opts.Direction is not penalized.
+// If opts.Tail is set, the score is further multiplied by (1 - rp95)*(1 -
+// rp99), the relative differences of the percentiles, compared in the same
+// way as the averages. If any difference is not within its threshold, miss
+// describes the failure, and the error message of score includes the P95 and
+// P99 of both metrics if opts.Tail is set or they were computed. A metric
+// without deltas in either Stats, such as one of a single sample, scores 1.
+func compareMetrics(sa, sb Stats, key string, opts CompareOptions) (score CmpScore, miss *MetricMiss) {
+	threshold := opts.threshold()
+	dir := opts.direction(key)
+	spread := opts.Spread
+	if spread == nil {
+		spread = VarSpread
+	}
 	score.Metric = key
+	score.Score = 1
 	a := sa.Metrics[key]
 	b := sb.Metrics[key]
-	if a.Avg == b.Avg {
-		score.Score = 1
-		return
-	}
-	maxavg := math.Max(math.Abs(float64(a.Avg)), math.Abs(float64(b.Avg)))
-	maxvar := math.Max(math.Abs(float64(a.Var)), math.Abs(float64(b.Var)))
-	if maxavg == 0 || maxvar == 0 {
-		score.Score = 1
-		return
+	if a.Var < 0 || b.Var < 0 {
+		return // no deltas, as for a single sample, so nothing to compare
 	}
 
-	relavg := math.Abs(float64(a.Avg-b.Avg)) / maxavg
-	relvar := math.Abs(float64(a.Var-b.Var)) / maxvar
+	// the averages and spreads are compared independently, so that metrics
+	// without spread, such as counters increasing at a steady rate, still
+	// have their averages compared
+	relavg := relDiff(a.Avg, b.Avg, dir)
+	var relvar float64
+	aSpread, bSpread := spread(a), spread(b)
+	maxvar := math.Max(math.Abs(aSpread), math.Abs(bSpread))
+	if maxvar != 0 {
+		relvar = math.Abs(aSpread-bSpread) / maxvar
+	}
 	score.Score = math.Abs((1 - relavg) * (1 - relvar))
 
+	var rel95, rel99 float64
+	if opts.Tail {
+		rel95 = relDiff(a.P95, b.P95, dir)
+		rel99 = relDiff(a.P99, b.P99, dir)
+		score.Score *= (1 - rel95) * (1 - rel99)
+	}
+	tailThreshold := opts.tailThreshold()
+
+	if relavg <= threshold && relvar <= threshold &&
+		rel95 <= tailThreshold && rel99 <= tailThreshold {
+		return
+	}
+	miss = &MetricMiss{
+		Key:      key,
+		A:        a,
+		B:        b,
+		AvgMiss:  relavg > threshold,
+		VarMiss:  relvar > threshold,
+		TailMiss: rel95 > tailThreshold || rel99 > tailThreshold,
+	}
+
+	// show where in the distribution the averages and spreads moved, if
+	// the percentiles were computed
+	var tail string
+	if opts.Tail || hasPercentiles(a) || hasPercentiles(b) {
+		tail = fmt.Sprintf("; P95 (%d, %d), P99 (%d, %d)",
+			a.P95, b.P95, a.P99, b.P99)
+	}
 	var msg string
-	if relavg > CmpThreshold {
+	if miss.AvgMiss {
 		msg = fmt.Sprintf("metric '%s' not proximal: "+
-			"averages (%d, %d) are not within threshold (%d%%)\n",
-			key, a.Avg, b.Avg, int(CmpThreshold*100))
+			"averages (%d, %d) are not within threshold (%d%%)%s\n",
+			key, a.Avg, b.Avg, int(threshold*100), tail)
 	}
-	if relvar > CmpThreshold {
+	if miss.VarMiss && opts.Spread == nil {
+		msg += fmt.Sprintf("metric '%s' not proximal: "+
+			"variances (%d, %d) are not within threshold (%d%%)%s\n",
+			key, a.Var, b.Var, int(threshold*100), tail)
+	} else if miss.VarMiss {
 		msg += fmt.Sprintf("metric '%s' not proximal: "+
-			"variances (%d, %d) are not within threshold (%d%%)\n",
-			key, a.Var, b.Var, int(CmpThreshold*100))
+			"spreads (%g, %g) are not within threshold (%d%%)%s\n",
+			key, aSpread, bSpread, int(threshold*100), tail)
 	}
-	if msg != "" {
-		score.Err = fmt.Errorf("%s", msg)
+	if miss.TailMiss {
+		msg += fmt.Sprintf("metric '%s' not proximal: "+
+			"P95 (%d, %d) or P99 (%d, %d) are not within threshold (%d%%)\n",
+			key, a.P95, b.P95, a.P99, b.P99, int(tailThreshold*100))
 	}
+	score.Err = fmt.Errorf("%s", msg)
 	return
 }
+
+// belowMinAvg returns whether the averages of a and b, which both have
+// deltas, are below min in magnitude.
+func belowMinAvg(a, b MetricStat, min int64) bool {
+	if a.Var < 0 || b.Var < 0 {
+		return false
+	}
+	return abs(a.Avg) < min && abs(b.Avg) < min
+}
+
+// hasPercentiles returns whether the percentiles of s were computed.
+func hasPercentiles(s MetricStat) bool {
+	return s.Percentiles
+}
+
+// relDiff returns the relative difference of a and b: their difference
+// divided by the larger magnitude, or 1 if their signs differ. A difference
+// in the direction favored by dir is 0.
+func relDiff(a, b int64, dir CompareDirection) float64 {
+	if a == b ||
+		(dir == HigherIsBetter && b > a) ||
+		(dir == LowerIsBetter && b < a) {
+		return 0
+	}
+	if (a < 0 && b > 0) || (a > 0 && b < 0) {
+		// dividing the span by the larger magnitude gives up to 2 when the
+		// signs differ, which would score as a near match
+		return 1
+	}
+	return math.Abs(float64(a-b)) / math.Max(math.Abs(float64(a)), math.Abs(float64(b)))
+}
@@ -0,0 +1,198 @@
+package ftdc
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestRelDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b int64
+		dir  CompareDirection
+		want float64
+	}{
+		{"equal", 5, 5, TwoSided, 0},
+		{"both zero", 0, 0, TwoSided, 0},
+		{"increase", 80, 100, TwoSided, 0.2},
+		{"decrease", 100, 80, TwoSided, 0.2},
+		{"negative", -100, -80, TwoSided, 0.2},
+		{"from zero", 0, 5, TwoSided, 1},
+		{"sign flip", -5, 5, TwoSided, 1},
+		{"sign flip of large values", 1000, -1000, TwoSided, 1},
+		{"near zero crossing", -1, 1, TwoSided, 1},
+		{"uneven crossing", -1, 1000, TwoSided, 1},
+		{"favored increase", 80, 100, HigherIsBetter, 0},
+		{"penalized decrease", 100, 80, HigherIsBetter, 0.2},
+		{"favored decrease", 100, 80, LowerIsBetter, 0},
+		{"penalized sign flip", -5, 5, LowerIsBetter, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := relDiff(tc.a, tc.b, tc.dir)
+			if math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("relDiff(%d, %d) = %v, expected %v", tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProximalSignFlip(t *testing.T) {
+	stats := func(avg int64) Stats {
+		return Stats{
+			NSamples: 10,
+			Metrics: map[string]MetricStat{
+				"serverStatus.x": {Avg: avg, Var: 4, NSamples: 10},
+			},
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		a, b int64
+		ok   bool
+	}{
+		{"same sign", 5, 5, true},
+		{"sign flip", -5, 5, false},
+		{"near zero crossing", -1, 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, scores, ok := ProximalWith(stats(tc.a), stats(tc.b), CompareOptions{
+				Include: []string{"serverStatus"},
+			})
+			if ok != tc.ok {
+				t.Errorf("got ok %v, expected %v: %v", ok, tc.ok, scores)
+			}
+		})
+	}
+}
+
+func TestProximalWithConcurrentThresholds(t *testing.T) {
+	stats := func(avg int64) Stats {
+		return Stats{
+			NSamples: 10,
+			Metrics: map[string]MetricStat{
+				"serverStatus.x": {Avg: avg, Var: 4, NSamples: 10},
+			},
+		}
+	}
+	// the averages differ by 15%
+	a, b := stats(100), stats(85)
+	tests := []struct {
+		threshold float64
+		miss      bool
+	}{
+		{0.1, true},
+		{0.2, false},
+		{0.05, true},
+		{0.5, false},
+	}
+
+	// whether the metric missed the threshold, as seen by each entry point
+	compare := map[string]func(opts CompareOptions) bool{
+		"ProximalWith": func(opts CompareOptions) bool {
+			_, scores, _ := ProximalWith(a, b, opts)
+			for _, s := range scores {
+				if s.Metric == "serverStatus.x" && s.Err != nil {
+					return true
+				}
+			}
+			return false
+		},
+		"ProximalDetailedWith": func(opts CompareOptions) bool {
+			return len(ProximalDetailedWith(a, b, opts).Misses) > 0
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 100*len(tests)*len(compare))
+	for i := 0; i < 100; i++ {
+		for name, f := range compare {
+			for _, tc := range tests {
+				name, f, tc := name, f, tc
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					miss := f(CompareOptions{
+						Include:   []string{"serverStatus"},
+						Threshold: tc.threshold,
+					})
+					if miss != tc.miss {
+						errs <- fmt.Sprintf("%s at threshold %v: got miss %v, expected %v",
+							name, tc.threshold, miss, tc.miss)
+					}
+				}()
+			}
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSpreadOfZeroPercentiles(t *testing.T) {
+	// mostly flat, so that every percentile and the MAD are 0 while the
+	// variance is not
+	deltas := make([]int64, 200)
+	deltas[100] = 1000
+	c := Chunk{NDeltas: len(deltas), Metrics: []Metric{
+		{Key: "serverStatus.x", Value: 5, Deltas: deltas},
+	}}
+	with := c.StatsWith(StatsOptions{Percentiles: true}).Metrics["serverStatus.x"]
+	without := c.Stats().Metrics["serverStatus.x"]
+	if with.P99 != 0 || with.MAD != 0 || with.Var == 0 {
+		t.Fatalf("got P99 %d, MAD %d, and variance %d", with.P99, with.MAD, with.Var)
+	}
+	for _, tc := range []struct {
+		name   string
+		spread SpreadFunc
+		stat   MetricStat
+		want   float64
+	}{
+		{"IQR", IQRSpread, with, 0},
+		{"MAD", MADSpread, with, 0},
+		{"IQR without percentiles", IQRSpread, without, float64(without.Var)},
+		{"MAD without percentiles", MADSpread, without, float64(without.Var)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.spread(tc.stat); got != tc.want {
+				t.Errorf("got spread %v, expected %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRatioTable(t *testing.T) {
+	stats := func(avg int64) Stats {
+		return Stats{Metrics: map[string]MetricStat{
+			"serverStatus.x": {Avg: avg, Var: 4, NSamples: 10},
+		}}
+	}
+	for _, tc := range []struct {
+		name                string
+		baseline, candidate int64
+		want                float64
+	}{
+		{"equal", 5, 5, 1},
+		{"both zero", 0, 0, 1},
+		{"doubled", 5, 10, 2},
+		{"sign flip", 5, -5, -1},
+		{"from zero to positive", 0, 5, math.Inf(1)},
+		{"from zero to negative", 0, -5, math.Inf(-1)},
+		// beyond the range of a 32-bit int
+		{"from zero to large positive", 0, 1 << 40, math.Inf(1)},
+		{"from zero to large negative", 0, -1 << 40, math.Inf(-1)},
+		{"from zero to a multiple of 2^32", 0, -1 << 32, math.Inf(-1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := RatioTableWith(stats(tc.baseline), stats(tc.candidate), CompareOptions{
+				Include: []string{"serverStatus"},
+			})["serverStatus.x"]
+			if got != tc.want {
+				t.Errorf("got ratio %v, expected %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package ftdc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compression is the compression method of the data of metric chunks.
+type Compression int
+
+// The compression methods supported by ChunkWriter. Zstd is only available
+// when built with the 'zstd' tag.
+const (
+	Zlib Compression = iota
+	Zstd
+)
+
+// zstdMagic is the frame magic number with which zstd-compressed data starts.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdDecode and newZstdWriter are set by zstd.go when built with the 'zstd'
+// tag.
+var (
+	zstdDecode    func(b []byte) ([]byte, error)
+	newZstdWriter func(w io.Writer) (io.WriteCloser, error)
+)
+
+// decompressor returns a reader of the decompressed chunk data in b, which is
+// compressed with zlib or zstd, as told apart by the header of b.
+func decompressor(b []byte) (io.Reader, error) {
+	if !bytes.HasPrefix(b, zstdMagic) {
+		return zlib.NewReader(bytes.NewReader(b))
+	}
+	if zstdDecode == nil {
+		return nil, fmt.Errorf("zstd-compressed chunk requires building with the 'zstd' tag")
+	}
+	out, err := zstdDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+// compressor returns a writer compressing to w with the given method.
+func compressor(w io.Writer, method Compression) (io.WriteCloser, error) {
+	switch method {
+	case Zlib:
+		return zlib.NewWriter(w), nil
+	case Zstd:
+		if newZstdWriter == nil {
+			return nil, fmt.Errorf("zstd compression requires building with the 'zstd' tag")
+		}
+		return newZstdWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression method: %d", method)
+}
@@ -0,0 +1,32 @@
+//go:build !zstd
+
+package ftdc
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestZstdRequiresTag(t *testing.T) {
+	var buf bytes.Buffer
+	err := NewChunkWriterWith(&buf, EncodeOptions{Compression: Zstd}).WriteChunk(testChunk(1600000000000, 10))
+	if err == nil {
+		t.Error("writing a zstd-compressed chunk succeeded without the 'zstd' tag")
+	}
+
+	data := append([]byte{0, 0, 0, 0}, zstdMagic...)
+	doc, err := bson.Marshal(bson.D{
+		{Name: "_id", Value: msTime(1600000000000)},
+		{Name: "type", Value: 1},
+		{Name: "data", Value: data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := NewChunkReader(bytes.NewReader(doc))
+	if cr.Next() || cr.Err() == nil {
+		t.Error("reading a zstd-compressed chunk succeeded without the 'zstd' tag")
+	}
+}
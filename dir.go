@@ -0,0 +1,342 @@
+package ftdc
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// interimFile is the name of the file holding mongod's most recent,
+// uncommitted metric chunk within a diagnostic.data directory.
+const interimFile = "metrics.interim"
+
+// ChunksDir reads a diagnostic.data directory as written by mongod, and
+// yields chunks on the given channel. The 'metrics.*' files are read in
+// timestamp order, followed by 'metrics.interim' if it is present. Chunks of
+// the interim file which do not start after the last chunk already read are
+// skipped, since they duplicate data in the other files, as are chunks whose
+// Hash equals that of a chunk already read. The channel is closed when there
+// are no more chunks.
+func ChunksDir(dir string, c chan<- Chunk) error {
+	return chunksDir(dir, nil, c)
+}
+
+// Series holds the time and value of each sample of a metric.
+type Series struct {
+	Times  []time.Time
+	Values []int64
+}
+
+// MetricSeries returns the time and value of every sample of the metrics
+// whose keys are equal to or nested beneath the given key, or matched by it as
+// a pattern such as 'serverStatus.wiredTiger.*', as for ChunksFiltered,
+// across the chunks of a diagnostic.data directory, as read by ChunksDir. The
+// result maps the key of each metric found to its samples, sorted by time.
+// Only the matching metrics and the timestamps are retained while decoding.
+// Chunks lacking timestamps are skipped. It returns an error if the pattern
+// is malformed.
+func MetricSeries(dir string, key string) (map[string]Series, error) {
+	if err := checkKeyPatterns([]string{key}); err != nil {
+		return nil, err
+	}
+	prefixes := prefixSet([]string{key})
+	c := make(chan Chunk)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- chunksDir(dir, func(k string) bool {
+			return timestampKeys[k] || hasKeyPrefix(k, prefixes)
+		}, c)
+	}()
+	series := make(map[string]Series)
+	for chunk := range c {
+		ts, terr := chunk.Timestamps()
+		if terr != nil {
+			continue
+		}
+		for _, m := range chunk.Metrics {
+			if !hasKeyPrefix(m.Key, prefixes) || len(m.Deltas)+1 != len(ts) {
+				continue
+			}
+			s := series[m.Key]
+			s.Times = append(s.Times, ts...)
+			v := m.Value
+			s.Values = append(s.Values, v)
+			for _, d := range m.Deltas {
+				v += d
+				s.Values = append(s.Values, v)
+			}
+			series[m.Key] = s
+		}
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		sort.Stable(seriesByTime{s.Times, s.Values})
+	}
+	return series, nil
+}
+
+// DirPercentile estimates the p-th percentile, for p in (0, 100], of the
+// deltas of the metric with the given key across the chunks of a
+// diagnostic.data directory, as read by ChunksDir, such as the P99 of a
+// latency counter's per-sample increase over a whole capture. As in Stats,
+// deltas are only taken between samples of the same chunk. Only the metric
+// is retained while decoding, and the deltas are streamed through the P²
+// estimator used by StatsAccumulator, so the directory is read in constant
+// memory; the estimate has the accuracy described there. It returns an error
+// if the metric has no deltas.
+func DirPercentile(dir string, key string, p float64) (int64, error) {
+	if p <= 0 || p > 100 {
+		return 0, fmt.Errorf("percentile %g is not in (0, 100]", p)
+	}
+	c := make(chan Chunk)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- chunksDir(dir, func(k string) bool {
+			return k == key || timestampKeys[k]
+		}, c)
+	}()
+	q := newP2Quantile(p / 100)
+	for chunk := range c {
+		for _, m := range chunk.Metrics {
+			if m.Key != key {
+				continue
+			}
+			for _, d := range m.Deltas {
+				q.add(float64(d))
+			}
+		}
+	}
+	err := <-errCh
+	if err != nil {
+		return 0, err
+	}
+	if q.count == 0 {
+		return 0, fmt.Errorf("metric '%s' has no deltas in '%s'", key, dir)
+	}
+	return int64(math.Round(q.value())), nil
+}
+
+type seriesByTime struct {
+	ts     []time.Time
+	values []int64
+}
+
+func (s seriesByTime) Len() int           { return len(s.ts) }
+func (s seriesByTime) Less(i, j int) bool { return s.ts[i].Before(s.ts[j]) }
+func (s seriesByTime) Swap(i, j int) {
+	s.ts[i], s.ts[j] = s.ts[j], s.ts[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// chunksDir implements ChunksDir, retaining only the metrics for which keep
+// returns true if it is non-nil.
+func chunksDir(dir string, keep func(key string) bool, c chan<- Chunk) error {
+	defer close(c)
+	files, err := diagnosticFiles(dir)
+	if err != nil {
+		return err
+	}
+	var last int64
+	seen := make(map[uint64]bool)
+	for _, file := range files {
+		interim := filepath.Base(file) == interimFile
+		err = readFileChunks(file, keep, func(chunk Chunk) {
+			h := chunk.Hash()
+			if seen[h] {
+				return
+			}
+			seen[h] = true
+			first, end, ok := chunkTimes(chunk)
+			if !ok {
+				c <- chunk
+				return
+			}
+			if interim && first <= last {
+				return
+			}
+			if end > last {
+				last = end
+			}
+			c <- chunk
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChunksMerged reads the FTDC diagnostic files at the given paths, such as
+// those of the members of a sharded cluster, and yields their chunks on the
+// given channel interleaved in order of the time of each chunk's first
+// sample. Each file's chunks are expected to be in time order already, as
+// mongod writes them. Chunks without a 'start' metric are yielded as soon as
+// they are read, and chunks starting at the same time are yielded in the
+// order of paths. The channel is closed when there are no more chunks.
+func ChunksMerged(paths []string, c chan<- Chunk) error {
+	defer close(c)
+	var h mergeHeap
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src := &mergeSource{
+			path:  path,
+			index: i,
+			cr:    NewChunkReader(f),
+		}
+		if src.next() {
+			h = append(h, src)
+		} else if err := src.cr.Err(); err != nil {
+			return fmt.Errorf("failed to read '%s': %s", path, err)
+		}
+	}
+	heap.Init(&h)
+	for h.Len() > 0 {
+		src := h[0]
+		c <- src.chunk
+		if src.next() {
+			heap.Fix(&h, 0)
+			continue
+		}
+		if err := src.cr.Err(); err != nil {
+			return fmt.Errorf("failed to read '%s': %s", src.path, err)
+		}
+		heap.Pop(&h)
+	}
+	return nil
+}
+
+// mergeSource is a file read by ChunksMerged, holding its next chunk.
+type mergeSource struct {
+	path  string
+	index int
+	cr    *ChunkReader
+	chunk Chunk
+	first int64
+}
+
+func (s *mergeSource) next() bool {
+	if !s.cr.Next() {
+		return false
+	}
+	s.chunk = s.cr.Chunk()
+	first, _, ok := chunkTimes(s.chunk)
+	if !ok {
+		first = math.MinInt64
+	}
+	s.first = first
+	return true
+}
+
+// mergeHeap implements heap.Interface, ordering sources by the time of
+// their next chunk.
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].first != h[j].first {
+		return h[i].first < h[j].first
+	}
+	return h[i].index < h[j].index
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// ListMetricKeysDir returns the sorted union of the metric keys listed by
+// ListMetricKeys for each metric file of a diagnostic.data directory.
+func ListMetricKeysDir(dir string) ([]string, error) {
+	files, err := diagnosticFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		fkeys, err := ListMetricKeys(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read '%s': %s", file, err)
+		}
+		for _, k := range fkeys {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// diagnosticFiles lists the metric files of a diagnostic.data directory in
+// the order they should be read.
+func diagnosticFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	interim := false
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "metrics.") {
+			continue
+		}
+		if name == interimFile {
+			interim = true
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	// file names embed an ISO-8601 timestamp, so they sort chronologically
+	sort.Strings(files)
+	if interim {
+		files = append(files, filepath.Join(dir, interimFile))
+	}
+	return files, nil
+}
+
+func readFileChunks(file string, keep func(key string) bool, f func(Chunk)) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	cr := NewChunkReader(in)
+	cr.keep = keep
+	for cr.Next() {
+		f(cr.Chunk())
+	}
+	return cr.Err()
+}
+
+// chunkTimes returns the first and last values of the chunk's 'start' metric,
+// in milliseconds.
+func chunkTimes(c Chunk) (first, last int64, ok bool) {
+	for _, m := range c.Metrics {
+		if m.Key == "start" {
+			return m.Value, m.Value + sum(m.Deltas...), true
+		}
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package ftdc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMetricSeries(t *testing.T) {
+	dir := t.TempDir()
+	a, b := testChunk(1600000000000, 10), testChunk(1600000010000, 5)
+	for name, c := range map[string]Chunk{
+		"metrics.2020-09-13T12-26-40Z-00000": a,
+		"metrics.2020-09-13T12-26-50Z-00000": b,
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), encodeChunks(t, EncodeOptions{}, c), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	inserts := Series{}
+	for _, c := range []Chunk{a, b} {
+		ts, vs, err := c.series("serverStatus.opcounters.insert")
+		if err != nil {
+			t.Fatal(err)
+		}
+		inserts.Times = append(inserts.Times, ts...)
+		inserts.Values = append(inserts.Values, vs...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		keys []string
+		err  bool
+	}{
+		{"exact key", "serverStatus.opcounters.insert", []string{"serverStatus.opcounters.insert"}, false},
+		{"prefix", "serverStatus.opcounters", []string{"serverStatus.opcounters.insert"}, false},
+		{"pattern", "serverStatus.*.insert", []string{"serverStatus.opcounters.insert"}, false},
+		{"pattern of a prefix", "serverStatus.*", []string{
+			"serverStatus.asserts.regular",
+			"serverStatus.connections.current",
+			"serverStatus.opcounters.insert",
+		}, false},
+		{"no match", "serverStatus.*.update", nil, false},
+		{"malformed pattern", "serverStatus.[", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			series, err := MetricSeries(dir, tc.key)
+			if (err != nil) != tc.err {
+				t.Fatalf("got error %v, expected error: %v", err, tc.err)
+			}
+			var keys []string
+			for k, s := range series {
+				keys = append(keys, k)
+				if len(s.Times) != 15 || len(s.Values) != 15 {
+					t.Errorf("metric '%s': got %d times and %d values, expected 15",
+						k, len(s.Times), len(s.Values))
+				}
+				if !sort.SliceIsSorted(s.Times, func(i, j int) bool { return s.Times[i].Before(s.Times[j]) }) {
+					t.Errorf("metric '%s': samples are not sorted by time", k)
+				}
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tc.keys) {
+				t.Errorf("got keys %v, expected %v", keys, tc.keys)
+			}
+			if s, ok := series["serverStatus.opcounters.insert"]; ok && !reflect.DeepEqual(s, inserts) {
+				t.Errorf("got inserts %v, expected %v", s, inserts)
+			}
+		})
+	}
+}
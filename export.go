@@ -0,0 +1,252 @@
+package ftdc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteCSV writes the chunk's samples as CSV, with a header row of metric
+// keys and one row per sample. The 'start' timestamp metric is the first
+// column, followed by the remaining keys in sorted order. Metrics without a
+// value for a sample are written as empty fields.
+func (c *Chunk) WriteCSV(w io.Writer) error {
+	metrics := c.sortedMetrics()
+	cw := csv.NewWriter(w)
+	row := make([]string, len(metrics))
+	for i, m := range metrics {
+		row[i] = m.Key
+	}
+	err := cw.Write(row)
+	if err != nil {
+		return err
+	}
+	for j := 0; j <= c.NDeltas; j++ {
+		for i := range metrics {
+			m := &metrics[i]
+			switch {
+			case j == 0:
+				row[i] = strconv.FormatInt(m.Value, 10)
+			case j <= len(m.Deltas):
+				m.Value += m.Deltas[j-1]
+				row[i] = strconv.FormatInt(m.Value, 10)
+			default:
+				row[i] = ""
+			}
+		}
+		err = cw.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WritePrometheus writes the chunk's samples in the Prometheus text
+// exposition format. Each metric is named after its key with invalid
+// characters replaced by underscores, labeled with its original key, and
+// typed by its kind as found by Classify: a Counter, including one which
+// resets, as a counter, a Gauge as a gauge, and a Constant, which could be
+// either, as untyped. Each sample is written with its timestamp in
+// milliseconds.
+//
+// Metrics whose keys are replaced by the same name, such as 'a.b-c' and
+// 'a.b_c', are written as a single metric family, told apart by their key
+// labels, under one TYPE line. The family is untyped unless the metrics are
+// all of the same type.
+func (c *Chunk) WritePrometheus(w io.Writer) error {
+	ts, err := c.Timestamps()
+	if err != nil {
+		return err
+	}
+	var names []string
+	families := make(map[string][]Metric)
+	for _, m := range c.sortedMetrics() {
+		name := prometheusName(m.Key)
+		if _, ok := families[name]; !ok {
+			names = append(names, name)
+		}
+		families[name] = append(families[name], m)
+	}
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		family := families[name]
+		typ := prometheusType(classifyMetric(family[0], defaultResetTolerance))
+		for _, m := range family[1:] {
+			if prometheusType(classifyMetric(m, defaultResetTolerance)) != typ {
+				typ = "untyped"
+			}
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		for _, m := range family {
+			label := prometheusLabel.Replace(m.Key)
+			v := m.Value
+			for i := 0; i < len(ts) && i <= len(m.Deltas); i++ {
+				if i > 0 {
+					v += m.Deltas[i-1]
+				}
+				fmt.Fprintf(bw, "%s{key=\"%s\"} %d %d\n", name, label, v,
+					ts[i].UnixNano()/int64(time.Millisecond))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteNDJSON writes the samples of the chunks received on chunks as
+// newline-delimited JSON, one object per sample, until the channel is closed.
+// Each object has the sample's timestamp as an RFC3339 string in UTC under
+// 'ts', followed by each metric's value keyed as in WriteCSV. Metrics without
+// a value for a sample are omitted from its object. Output is flushed after
+// each chunk, so it is suitable for unbounded streams.
+//
+// Chunks without timestamps are skipped. If writing fails, the remaining
+// chunks are received and discarded before the error is returned, so that
+// the sender is not blocked.
+func WriteNDJSON(w io.Writer, chunks <-chan Chunk) error {
+	bw := bufio.NewWriter(w)
+	for c := range chunks {
+		ts, err := c.Timestamps()
+		if err != nil {
+			continue
+		}
+		metrics := c.sortedMetrics()
+		keys := make([][]byte, len(metrics))
+		for i, m := range metrics {
+			keys[i], err = json.Marshal(m.Key)
+			if err != nil {
+				drainChunks(chunks)
+				return err
+			}
+		}
+		for j := range ts {
+			fmt.Fprintf(bw, `{"ts":"%s"`, ts[j].UTC().Format(time.RFC3339Nano))
+			for i := range metrics {
+				m := &metrics[i]
+				if j > len(m.Deltas) {
+					continue
+				}
+				if j > 0 {
+					m.Value += m.Deltas[j-1]
+				}
+				fmt.Fprintf(bw, ",%s:%d", keys[i], m.Value)
+			}
+			bw.WriteString("}\n")
+		}
+		err = bw.Flush()
+		if err != nil {
+			drainChunks(chunks)
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteInfluxLineProtocol writes the samples of the chunks received on chunks
+// in the InfluxDB line protocol until the channel is closed, such as to
+// backfill a capture into InfluxDB. Each sample is written as a line of the
+// given measurement, with each metric's value as an integer field keyed by
+// metric key, and the sample's timestamp in nanoseconds. Metrics without a
+// value for a sample are omitted from its line. Output is flushed after each
+// chunk. As with WriteNDJSON, chunks without timestamps are skipped, and the
+// remaining chunks are drained if writing fails.
+func WriteInfluxLineProtocol(w io.Writer, chunks <-chan Chunk, measurement string) error {
+	bw := bufio.NewWriter(w)
+	name := influxMeasurement.Replace(measurement)
+	for c := range chunks {
+		ts, err := c.Timestamps()
+		if err != nil {
+			continue
+		}
+		metrics := c.sortedMetrics()
+		keys := make([]string, len(metrics))
+		for i, m := range metrics {
+			keys[i] = influxKey.Replace(m.Key)
+		}
+		var line bytes.Buffer
+		for j := range ts {
+			line.Reset()
+			line.WriteString(name)
+			sep := byte(' ')
+			for i := range metrics {
+				m := &metrics[i]
+				if j > len(m.Deltas) {
+					continue
+				}
+				if j > 0 {
+					m.Value += m.Deltas[j-1]
+				}
+				fmt.Fprintf(&line, "%c%s=%di", sep, keys[i], m.Value)
+				sep = ','
+			}
+			if sep == ' ' {
+				continue // a line must have at least one field
+			}
+			fmt.Fprintf(&line, " %d\n", ts[j].UnixNano())
+			bw.Write(line.Bytes())
+		}
+		err = bw.Flush()
+		if err != nil {
+			drainChunks(chunks)
+			return err
+		}
+	}
+	return nil
+}
+
+// influxMeasurement and influxKey escape measurement names and field keys of
+// the InfluxDB line protocol.
+var (
+	influxMeasurement = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxKey         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+var prometheusLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusType returns the Prometheus metric type of a metric of the
+// given kind.
+func prometheusType(k MetricKind) string {
+	switch k {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	}
+	return "untyped"
+}
+
+// prometheusName converts a metric key to a valid Prometheus metric name.
+func prometheusName(key string) string {
+	b := []byte(key)
+	for i, ch := range b {
+		valid := ch == '_' || ch == ':' ||
+			(ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
+			(i > 0 && ch >= '0' && ch <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// sortedMetrics returns a copy of the chunk's metrics with the 'start'
+// timestamp metric first, followed by the remaining metrics sorted by key.
+func (c *Chunk) sortedMetrics() []Metric {
+	metrics := make([]Metric, len(c.Metrics))
+	copy(metrics, c.Metrics)
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[j].Key == "start" {
+			return false
+		}
+		return metrics[i].Key == "start" || metrics[i].Key < metrics[j].Key
+	})
+	return metrics
+}
@@ -0,0 +1,61 @@
+package ftdc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheusNameCollisions(t *testing.T) {
+	c := Chunk{NDeltas: 2, Metrics: []Metric{
+		{Key: "start", Value: 1600000000000, Deltas: []int64{1000, 1000}},
+		{Key: "serverStatus.a.b_c", Value: 1, Deltas: []int64{1, 1}},
+		{Key: "serverStatus.a.b.d", Value: 7, Deltas: []int64{0, 0}},
+		{Key: "serverStatus.a.b-c", Value: 5, Deltas: []int64{-1, 2}},
+	}}
+	var buf bytes.Buffer
+	if err := c.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the TYPE line of each family, and the keys of its samples, in order
+	types := make(map[string]string)
+	var families []string
+	keys := make(map[string][]string)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			f := strings.Fields(line)
+			if _, ok := types[f[2]]; ok {
+				t.Errorf("metric '%s' is typed twice", f[2])
+			}
+			types[f[2]] = f[3]
+			families = append(families, f[2])
+			continue
+		}
+		name := line[:strings.Index(line, "{")]
+		if len(families) == 0 || families[len(families)-1] != name {
+			t.Fatalf("sample of '%s' is not under its TYPE line: %s", name, line)
+		}
+		key := line[strings.Index(line, `"`)+1 : strings.LastIndex(line, `"`)]
+		if l := keys[name]; len(l) == 0 || l[len(l)-1] != key {
+			keys[name] = append(keys[name], key)
+		}
+	}
+
+	want := map[string][]string{
+		"start":              {"start"},
+		"serverStatus_a_b_c": {"serverStatus.a.b-c", "serverStatus.a.b_c"},
+		"serverStatus_a_b_d": {"serverStatus.a.b.d"},
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got families %v, expected %v", keys, want)
+	}
+	// a gauge and a counter share a name, so the family is untyped
+	if typ := types["serverStatus_a_b_c"]; typ != "untyped" {
+		t.Errorf("got type '%s' for the colliding metrics, expected 'untyped'", typ)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != len(want)+3*4 {
+		t.Errorf("got %d lines, expected %d", n, len(want)+3*4)
+	}
+}
@@ -0,0 +1,47 @@
+package ftdc
+
+import (
+	"time"
+)
+
+// FilterChunks yields the chunks received on in for which pred returns true
+// on out. The out channel is closed once in is closed.
+func FilterChunks(in <-chan Chunk, pred func(Chunk) bool, out chan<- Chunk) {
+	defer close(out)
+	for c := range in {
+		if pred(c) {
+			out <- c
+		}
+	}
+}
+
+// HasMetric returns a predicate for FilterChunks which matches chunks that
+// contain the metric with the given key.
+func HasMetric(key string) func(Chunk) bool {
+	return func(c Chunk) bool {
+		for _, m := range c.Metrics {
+			if m.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TimeRange returns a predicate for FilterChunks which matches chunks with
+// samples overlapping the interval [start, end].
+func TimeRange(start, end time.Time) func(Chunk) bool {
+	return func(c Chunk) bool {
+		first, last, ok := chunkTimes(c)
+		if !ok {
+			return false
+		}
+		return !msTime(last).Before(start) && !msTime(first).After(end)
+	}
+}
+
+// msTime converts a time in milliseconds since the epoch, as used by FTDC
+// timestamp metrics, to a time.Time.
+func msTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
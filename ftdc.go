@@ -1,7 +1,12 @@
 package ftdc
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -12,6 +17,10 @@ import (
 type Chunk struct {
 	Metrics []Metric
 	NDeltas int
+
+	// reference is the raw BSON reference document of the chunk, if it was
+	// decoded from an FTDC file
+	reference []byte
 }
 
 // Map converts the chunk to a map representation.
@@ -23,65 +32,216 @@ func (c *Chunk) Map() map[string]Metric {
 	return m
 }
 
+// Reference returns the chunk's reference document, which holds the values
+// of the first sample decoded from the file along with non-numeric fields,
+// such as strings, that are not represented as metrics. It returns an error
+// if the chunk was not decoded from an FTDC file.
+func (c *Chunk) Reference() (doc bson.D, err error) {
+	if c.reference == nil {
+		err = fmt.Errorf("chunk has no reference document")
+		return
+	}
+	err = bson.Unmarshal(c.reference, &doc)
+	return
+}
+
+// Len returns the number of samples in the chunk.
+func (c *Chunk) Len() int {
+	return c.NDeltas + 1
+}
+
+// SampleCount returns the number of samples of the metric with the given key,
+// or 0 if the chunk has no such metric.
+func (c *Chunk) SampleCount(key string) int {
+	for _, m := range c.Metrics {
+		if m.Key == key {
+			return len(m.Deltas) + 1
+		}
+	}
+	return 0
+}
+
+// Hash returns an FNV-1a hash of the chunk's metric keys and sample values,
+// which include its timestamps. Chunks holding the same samples hash equal
+// regardless of the order of their metrics.
+func (c *Chunk) Hash() uint64 {
+	metrics := make([]Metric, len(c.Metrics))
+	copy(metrics, c.Metrics)
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Key < metrics[j].Key
+	})
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	for _, m := range metrics {
+		h.Write([]byte(m.Key))
+		h.Write([]byte{0})
+		v := m.Value
+		for i := -1; i < len(m.Deltas); i++ {
+			if i >= 0 {
+				v += m.Deltas[i]
+			}
+			binary.LittleEndian.PutUint64(b, uint64(v))
+			h.Write(b)
+		}
+		// separates the values of one metric from the key of the next
+		h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+// DeltaInfo describes how well a metric's deltas compress. FTDC encodes each
+// run of zero deltas as a pair of varints, so metrics with many non-zero
+// deltas account for most of a file's size.
+type DeltaInfo struct {
+	Zeros    int
+	NonZeros int
+
+	// Runs maps the length of each run of consecutive zero deltas to the
+	// number of such runs.
+	Runs map[int]int
+}
+
+// DeltaStats returns the DeltaInfo of each of the chunk's metrics. Runs are
+// counted within each metric, although the encoder may join a run at the end
+// of one metric with one at the start of the next.
+func (c *Chunk) DeltaStats() map[string]DeltaInfo {
+	out := make(map[string]DeltaInfo, len(c.Metrics))
+	for _, m := range c.Metrics {
+		di := DeltaInfo{Runs: make(map[int]int)}
+		run := 0
+		for _, d := range m.Deltas {
+			if d == 0 {
+				di.Zeros++
+				run++
+				continue
+			}
+			di.NonZeros++
+			if run > 0 {
+				di.Runs[run]++
+				run = 0
+			}
+		}
+		if run > 0 {
+			di.Runs[run]++
+		}
+		out[m.Key] = di
+	}
+	return out
+}
+
 // Clip trims the chunk to contain as little data as possible while keeping
 // data within the given interval. If the chunk is entirely outside of the
 // range, it is not modified and the return value is false.
 func (c *Chunk) Clip(start, end time.Time) bool {
 	st := start.Unix()
 	et := end.Unix()
-	var si, ei int
+	si, ei := -1, -1
+	found := false
 	for _, m := range c.Metrics {
 		if m.Key != "start" {
 			continue
 		}
-		mst := int64(m.Value) / 1000
-		met := (int64(m.Value) + int64(sum(m.Deltas...))) / 1000
-		if met < st || mst > et {
-			return false // entire chunk outside range
-		}
-		if mst > st && met < et {
-			return true // entire chunk inside range
-		}
-		t := mst
-		for i := 0; i < c.NDeltas; i++ {
-			t += int64(m.Deltas[i]) / 1000
-			if t < st {
-				si++
+		t := m.Value
+		for i := 0; i <= c.NDeltas; i++ {
+			if i > 0 {
+				t += m.Deltas[i-1]
 			}
-			if t < et {
-				ei++
-			} else {
+			if t/1000 < st {
+				continue
+			}
+			if t/1000 > et {
 				break
 			}
+			if si < 0 {
+				si = i
+			}
+			ei = i
 		}
-		if ei+1 < c.NDeltas {
-			ei++ // inclusive of end time
-		} else {
-			ei = c.NDeltas - 1
-		}
+		found = true
 		break
 	}
+	if !found {
+		return true
+	}
+	if si < 0 {
+		return false // entire chunk outside range
+	}
 	c.NDeltas = ei - si
-	for _, m := range c.Metrics {
+	for i := range c.Metrics {
+		m := &c.Metrics[i]
 		m.Value += sum(m.Deltas[:si]...)
-		m.Deltas = m.Deltas[si : ei+1]
+		m.Deltas = m.Deltas[si:ei]
 	}
 	return true
 }
 
+// ClipSamples returns a chunk holding samples [start, end) of the chunk, such
+// as to drop warmup samples regardless of their timestamps. The bounds are
+// clamped to the samples available, and if no samples remain the returned
+// chunk has no metrics. The deltas of the returned chunk share storage with c.
+func (c *Chunk) ClipSamples(start, end int) Chunk {
+	if start < 0 {
+		start = 0
+	}
+	if end > c.NDeltas+1 {
+		end = c.NDeltas + 1
+	}
+	if start >= end {
+		return Chunk{reference: c.reference}
+	}
+	out := Chunk{
+		Metrics:   make([]Metric, 0, len(c.Metrics)),
+		NDeltas:   end - start - 1,
+		reference: c.reference,
+	}
+	for _, m := range c.Metrics {
+		if start > len(m.Deltas) {
+			continue // metric has no samples in range
+		}
+		j := end - 1
+		if j > len(m.Deltas) {
+			j = len(m.Deltas)
+		}
+		out.Metrics = append(out.Metrics, Metric{
+			Key:    m.Key,
+			Value:  m.Value + sum(m.Deltas[:start]...),
+			Deltas: m.Deltas[start:j],
+		})
+	}
+	return out
+}
+
+// slice returns a chunk holding samples [i, j) of the chunk. The deltas of
+// the returned chunk share storage with c.
+func (c *Chunk) slice(i, j int) Chunk {
+	out := Chunk{
+		Metrics:   make([]Metric, len(c.Metrics)),
+		NDeltas:   j - i - 1,
+		reference: c.reference,
+	}
+	for k, m := range c.Metrics {
+		out.Metrics[k] = Metric{
+			Key:    m.Key,
+			Value:  m.Value + sum(m.Deltas[:i]...),
+			Deltas: m.Deltas[i : j-1],
+		}
+	}
+	return out
+}
+
 // Expand accumulates all deltas to give values of diagnostic data for each
 // sample represented by the Chunk. includeKeys specifies which items should be
 // included in the output. If a value of includeKeys is false, it won't be
 // shown even if the value for a parent document is set to true. If includeKeys
 // is nil, data for every key is returned.
-func (c *Chunk) Expand(includeKeys map[string]bool) []map[string]int {
+func (c *Chunk) Expand(includeKeys map[string]bool) []map[string]int64 {
 	// Initialize data structures
-	deltas := make([]map[string]int, 0, c.NDeltas+1)
-	last := make(map[string]int)
+	deltas := make([]map[string]int64, 0, c.NDeltas+1)
+	last := make(map[string]int64)
 
 	// Expand deltas
 	for i := -1; i < c.NDeltas; i++ {
-		d := make(map[string]int)
+		d := make(map[string]int64)
 		for _, m := range c.Metrics {
 			v, ok := last[m.Key]
 			if !ok {
@@ -118,27 +278,218 @@ func (c *Chunk) Expand(includeKeys map[string]bool) []map[string]int {
 	return deltas
 }
 
+// ConcatChunks joins time-ordered chunks into a single chunk, with the samples
+// of each metric concatenated. Every chunk must have the same set of metrics,
+// and each chunk's samples must start after those of the preceding chunk.
+func ConcatChunks(chunks []Chunk) (Chunk, error) {
+	if len(chunks) == 0 {
+		return Chunk{}, fmt.Errorf("no chunks to concatenate")
+	}
+	first := chunks[0]
+	out := Chunk{
+		Metrics:   make([]Metric, len(first.Metrics)),
+		NDeltas:   first.NDeltas,
+		reference: first.reference,
+	}
+	index := make(map[string]int, len(first.Metrics))
+	for i, m := range first.Metrics {
+		index[m.Key] = i
+		out.Metrics[i] = Metric{
+			Key:    m.Key,
+			Value:  m.Value,
+			Deltas: append([]int64(nil), m.Deltas...),
+		}
+	}
+	_, last, _ := chunkTimes(first)
+	for n, c := range chunks[1:] {
+		if len(c.Metrics) != len(out.Metrics) {
+			return Chunk{}, fmt.Errorf("chunk %d has %d metrics, expected %d",
+				n+1, len(c.Metrics), len(out.Metrics))
+		}
+		start, end, ok := chunkTimes(c)
+		if ok && start <= last {
+			return Chunk{}, fmt.Errorf("chunk %d starts before the end of the preceding chunk", n+1)
+		}
+		last = end
+		for _, m := range c.Metrics {
+			i, ok := index[m.Key]
+			if !ok {
+				return Chunk{}, fmt.Errorf("metric '%s' of chunk %d is missing from chunk 0", m.Key, n+1)
+			}
+			o := &out.Metrics[i]
+			prev := o.Value + sum(o.Deltas...)
+			o.Deltas = append(o.Deltas, m.Value-prev)
+			o.Deltas = append(o.Deltas, m.Deltas...)
+		}
+		out.NDeltas += c.NDeltas + 1
+	}
+	return out, nil
+}
+
 // Chunks takes an FTDC diagnostic file in the form of an io.Reader, and
 // yields chunks on the given channel. The channel is closed when there are
 // no more chunks.
 func Chunks(r io.Reader, c chan<- Chunk) error {
-	errCh := make(chan error)
-	ch := make(chan bson.D)
-	abrt := make(chan bool)
-	go func() {
-		errCh <- readDiagnostic(r, ch, abrt)
-	}()
-	go func() {
-		errCh <- readChunks(ch, c, abrt)
-	}()
-	err := <-errCh
+	return ChunksContext(context.Background(), r, c)
+}
+
+// ChunksWith is like Chunks, but decodes as configured by opts.
+func ChunksWith(r io.Reader, c chan<- Chunk, opts DecodeOptions) error {
+	defer close(c)
+	cr := NewChunkReaderWith(r, opts)
+	for cr.Next() {
+		c <- cr.Chunk()
+	}
+	return cr.Err()
+}
+
+// ChunksBytes is like Chunks, but reads the FTDC diagnostic file held in
+// data. Each document is decoded in place rather than first being copied out
+// of the input, so data must not be modified until ChunksBytes returns.
+func ChunksBytes(data []byte, c chan<- Chunk) error {
+	defer close(c)
+	cr := &ChunkReader{
+		data:  data,
+		total: int64(len(data)),
+	}
+	for cr.Next() {
+		c <- cr.Chunk()
+	}
+	return cr.Err()
+}
+
+// ChunksAuto is like Chunks, but also accepts an FTDC diagnostic file
+// wrapped in gzip.
+func ChunksAuto(r io.Reader, c chan<- Chunk) error {
+	ar, err := AutoReader(r)
+	if err != nil {
+		close(c)
+		return err
+	}
+	return Chunks(ar, c)
+}
+
+// ChunksContext is like Chunks, but stops reading and returns ctx.Err() once
+// the context is done. The context is checked between chunks, so at most one
+// chunk is decoded after cancellation.
+func ChunksContext(ctx context.Context, r io.Reader, c chan<- Chunk) error {
+	defer close(c)
+	cr := NewChunkReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !cr.Next() {
+			break
+		}
+		select {
+		case c <- cr.Chunk():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return cr.Err()
+}
+
+// ChunksFrom is like Chunks, but starts reading at the given byte offset of
+// r, which must be the start of a document: either 0, or an offset returned
+// by ChunksFrom or ChunkReader.Offset. It returns the offset of the document
+// following the last chunk yielded, from which a later call can resume, even
+// if an error occurs.
+func ChunksFrom(r io.ReadSeeker, offset int64, c chan<- Chunk) (nextOffset int64, err error) {
+	defer close(c)
+	_, err = r.Seek(offset, io.SeekStart)
 	if err != nil {
-		close(abrt)
-		<-errCh
-	} else {
-		err = <-errCh
+		return offset, err
+	}
+	cr := NewChunkReader(r)
+	cr.offset = offset
+	nextOffset = offset
+	for cr.Next() {
+		c <- cr.Chunk()
+		nextOffset = cr.Offset()
+	}
+	return nextOffset, cr.Err()
+}
+
+// ChunkWithOffset is a chunk along with the location of its document in the
+// FTDC diagnostic file it was read from.
+type ChunkWithOffset struct {
+	Chunk
+	Offset int64
+	Length int64
+}
+
+// ChunksWithOffsets is like Chunks, but yields each chunk with the byte
+// offset and length of its document, such as to build an index from which
+// chunks can later be read individually with ReadChunkAt.
+func ChunksWithOffsets(r io.Reader, c chan<- ChunkWithOffset) error {
+	defer close(c)
+	cr := NewChunkReader(r)
+	for cr.Next() {
+		offset, length := cr.ChunkOffset()
+		c <- ChunkWithOffset{
+			Chunk:  cr.Chunk(),
+			Offset: offset,
+			Length: length,
+		}
+	}
+	return cr.Err()
+}
+
+// ChunksClipped is like Chunks, but only yields chunks with samples within the
+// given interval, clipped to fit using Chunk.Clip. Chunks starting after the
+// end of the interval are skipped without being decoded.
+func ChunksClipped(r io.Reader, start, end time.Time, c chan<- Chunk) error {
+	defer close(c)
+	cr := NewChunkReader(r)
+	et := end.Unix()
+	cr.skip = func(doc bson.M) bool {
+		id, ok := doc["_id"].(time.Time)
+		return ok && id.Unix() > et
+	}
+	for cr.Next() {
+		chunk := cr.Chunk()
+		if chunk.Clip(start, end) {
+			c <- chunk
+		}
+	}
+	return cr.Err()
+}
+
+// ChunksFiltered is like Chunks, but the yielded chunks only contain metrics
+// whose keys are equal to or nested beneath one of the given keys, or matched
+// by one of them as a pattern, as for CompareOptions.Include. The timestamp
+// metrics, 'start' and 'end' and their 'serverStatus' counterparts, are
+// always kept. It returns an error if a pattern is malformed.
+func ChunksFiltered(r io.Reader, keys []string, c chan<- Chunk) error {
+	defer close(c)
+	if err := checkKeyPatterns(keys); err != nil {
+		return err
+	}
+	cr := NewChunkReader(r)
+	prefixes := prefixSet(keys)
+	cr.keep = func(key string) bool {
+		return timestampKeys[key] || hasKeyPrefix(key, prefixes)
+	}
+	for cr.Next() {
+		c <- cr.Chunk()
+	}
+	return cr.Err()
+}
+
+// ChunksLenient is like Chunks, but chunks which fail to decode, such as those
+// with truncated compressed data, are skipped rather than ending the stream.
+// The decode errors of skipped chunks are returned in skipped, and err is only
+// set if the file's framing cannot be read.
+func ChunksLenient(r io.Reader, c chan<- Chunk) (skipped []error, err error) {
+	defer close(c)
+	cr := NewChunkReader(r)
+	cr.lenient = true
+	for cr.Next() {
+		c <- cr.Chunk()
 	}
-	return err
+	return cr.skipped, cr.Err()
 }
 
 // Metric represents an item in a chunk.
@@ -148,9 +499,9 @@ type Metric struct {
 	Key string
 
 	// Value is the value of the metric at the beginning of the sample
-	Value int
+	Value int64
 
 	// Deltas is the slice of deltas, which accumulate on Value to yield the
 	// specific sample's value.
-	Deltas []int
+	Deltas []int64
 }
@@ -0,0 +1,196 @@
+package ftdc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testChunk returns a chunk of n samples taken a second apart from start, in
+// milliseconds since the epoch, with a counter, a gauge, and a constant.
+func testChunk(start int64, n int) Chunk {
+	c := Chunk{NDeltas: n - 1}
+	for _, key := range []string{
+		"start",
+		"serverStatus.opcounters.insert",
+		"serverStatus.connections.current",
+		"serverStatus.asserts.regular",
+	} {
+		m := Metric{Key: key, Deltas: make([]int64, n-1)}
+		switch key {
+		case "start":
+			m.Value = start
+		case "serverStatus.connections.current":
+			m.Value = 100
+		}
+		for i := range m.Deltas {
+			switch key {
+			case "start":
+				m.Deltas[i] = 1000
+			case "serverStatus.opcounters.insert":
+				m.Deltas[i] = int64(i%7) * 10
+			case "serverStatus.connections.current":
+				m.Deltas[i] = int64(i%3 - 1)
+			}
+		}
+		c.Metrics = append(c.Metrics, m)
+	}
+	return c
+}
+
+// encodeChunks writes the chunks as an FTDC diagnostic file.
+func encodeChunks(t testing.TB, opts EncodeOptions, chunks ...Chunk) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	cw := NewChunkWriterWith(&buf, opts)
+	for _, c := range chunks {
+		err := cw.WriteChunk(c)
+		if err != nil {
+			t.Fatalf("failed to write chunk: %s", err)
+		}
+	}
+	err := cw.Close()
+	if err != nil {
+		t.Fatalf("failed to close writer: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// decodeChunks reads all of the chunks of an FTDC diagnostic file.
+func decodeChunks(t testing.TB, data []byte) []Chunk {
+	t.Helper()
+	return decodeChunksWith(t, data, DecodeOptions{})
+}
+
+// decodeChunksWith is like decodeChunks, but decodes as configured by opts.
+func decodeChunksWith(t testing.TB, data []byte, opts DecodeOptions) []Chunk {
+	t.Helper()
+	var cs []Chunk
+	cr := NewChunkReaderWith(bytes.NewReader(data), opts)
+	for cr.Next() {
+		cs = append(cs, cr.Chunk())
+	}
+	if err := cr.Err(); err != nil {
+		t.Fatalf("failed to read chunks: %s", err)
+	}
+	return cs
+}
+
+// checkSameSamples fails the test unless got holds the same samples of the
+// same metrics as want, in any order of metrics.
+func checkSameSamples(t testing.TB, got, want Chunk) {
+	t.Helper()
+	if got.NDeltas != want.NDeltas || len(got.Metrics) != len(want.Metrics) {
+		t.Fatalf("got %d metrics with %d deltas, expected %d with %d",
+			len(got.Metrics), got.NDeltas, len(want.Metrics), want.NDeltas)
+	}
+	gm := got.Map()
+	for _, w := range want.Metrics {
+		g, ok := gm[w.Key]
+		if !ok {
+			t.Fatalf("metric '%s' not found", w.Key)
+		}
+		if g.Value != w.Value || len(g.Deltas) != len(w.Deltas) {
+			t.Fatalf("metric '%s': got %d with %d deltas, expected %d with %d",
+				w.Key, g.Value, len(g.Deltas), w.Value, len(w.Deltas))
+		}
+		for i := range w.Deltas {
+			if g.Deltas[i] != w.Deltas[i] {
+				t.Fatalf("metric '%s': delta %d is %d, expected %d",
+					w.Key, i, g.Deltas[i], w.Deltas[i])
+			}
+		}
+	}
+}
+
+// collectChunks returns the chunks yielded by f on the channel it is given,
+// along with its error.
+func collectChunks(f func(c chan<- Chunk) error) ([]Chunk, error) {
+	c := make(chan Chunk)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- f(c)
+	}()
+	var cs []Chunk
+	for chunk := range c {
+		cs = append(cs, chunk)
+	}
+	return cs, <-errc
+}
+
+func TestChunksBytes(t *testing.T) {
+	data := encodeChunks(t, EncodeOptions{},
+		testChunk(1600000000000, 300), wideChunk(50), testChunk(1600000300000, 1))
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  bool
+	}{
+		{"empty", nil, false},
+		{"one chunk", data[:len(encodeChunks(t, EncodeOptions{}, testChunk(1600000000000, 300)))], false},
+		{"many chunks", data, false},
+		{"truncated", data[:len(data)-3], true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want, rerr := collectChunks(func(c chan<- Chunk) error {
+				return Chunks(bytes.NewReader(tc.data), c)
+			})
+			got, err := collectChunks(func(c chan<- Chunk) error {
+				return ChunksBytes(tc.data, c)
+			})
+			if (err != nil) != tc.err || (rerr != nil) != tc.err {
+				t.Fatalf("got errors %v and %v, expected error: %v", err, rerr, tc.err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %d chunks differing from the %d read by Chunks", len(got), len(want))
+			}
+		})
+	}
+}
+
+func BenchmarkChunks(b *testing.B) {
+	data := encodeChunks(b, EncodeOptions{}, wideChunk(2000), wideChunk(2000))
+	for _, bc := range []struct {
+		name   string
+		chunks func(c chan<- Chunk) error
+	}{
+		{"reader", func(c chan<- Chunk) error { return Chunks(bytes.NewReader(data), c) }},
+		{"bytes", func(c chan<- Chunk) error { return ChunksBytes(data, c) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := collectChunks(bc.chunks)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestChunksFilteredKeepsTimestamps(t *testing.T) {
+	c := testChunk(1600000000000, 5)
+	c.Metrics[0].Key = "serverStatus.start"
+	data := encodeChunks(t, EncodeOptions{}, c)
+	want, err := c.Timestamps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := collectChunks(func(ch chan<- Chunk) error {
+		return ChunksFiltered(bytes.NewReader(data), []string{"serverStatus.asserts"}, ch)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0].Metrics) != 2 {
+		t.Fatalf("got %v, expected one chunk with the timestamps and the assert count", got)
+	}
+	ts, err := got[0].Timestamps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ts, want) {
+		t.Errorf("got timestamps %v, expected %v", ts, want)
+	}
+}
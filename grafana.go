@@ -0,0 +1,91 @@
+package ftdc
+
+import (
+	"sort"
+	"time"
+)
+
+// GrafanaRange is the time range of a Grafana SimpleJSON query.
+type GrafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// GrafanaTarget is a metric requested by a Grafana SimpleJSON query.
+type GrafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+}
+
+// GrafanaQueryRequest is the body of a Grafana SimpleJSON '/query' request.
+type GrafanaQueryRequest struct {
+	Range         GrafanaRange    `json:"range"`
+	Targets       []GrafanaTarget `json:"targets"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+}
+
+// GrafanaTimeSeries is an entry of a Grafana SimpleJSON '/query' response,
+// holding [value, milliseconds since the epoch] pairs.
+type GrafanaTimeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// GrafanaSearch returns the response to a Grafana SimpleJSON '/search'
+// request: the sorted keys of the metrics of the chunks.
+func GrafanaSearch(chunks []Chunk) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, c := range chunks {
+		for _, m := range c.Metrics {
+			if !seen[m.Key] {
+				seen[m.Key] = true
+				keys = append(keys, m.Key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GrafanaQuery returns the response to a Grafana SimpleJSON '/query' request
+// from time-ordered chunks, with one series per target holding the samples of
+// the metric within the request's range. If the request sets MaxDataPoints,
+// series with more samples are thinned to at most that many by keeping
+// evenly spaced samples. Chunks lacking a target's metric are skipped for
+// that target. The result encodes as the JSON expected by Grafana.
+func GrafanaQuery(chunks []Chunk, req GrafanaQueryRequest) []GrafanaTimeSeries {
+	out := make([]GrafanaTimeSeries, 0, len(req.Targets))
+	for _, t := range req.Targets {
+		series := GrafanaTimeSeries{
+			Target:     t.Target,
+			Datapoints: make([][2]float64, 0),
+		}
+		for i := range chunks {
+			ts, vs, err := chunks[i].series(t.Target)
+			if err != nil {
+				continue
+			}
+			for j := range ts {
+				if ts[j].Before(req.Range.From) || ts[j].After(req.Range.To) {
+					continue
+				}
+				series.Datapoints = append(series.Datapoints, [2]float64{
+					float64(vs[j]),
+					float64(ts[j].UnixNano() / int64(time.Millisecond)),
+				})
+			}
+		}
+		if n := len(series.Datapoints); req.MaxDataPoints > 0 && n > req.MaxDataPoints {
+			stride := (n + req.MaxDataPoints - 1) / req.MaxDataPoints
+			kept := series.Datapoints[:0]
+			for j := 0; j < n; j += stride {
+				kept = append(kept, series.Datapoints[j])
+			}
+			series.Datapoints = kept
+		}
+		out = append(out, series)
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package ftdc
+
+// MetricKind is the kind of quantity a metric measures, as inferred from its
+// sample values by Chunk.Classify.
+type MetricKind int
+
+// The kinds of metric distinguished by Chunk.Classify.
+const (
+	// Counter is a metric whose values never decrease, except for a reset.
+	Counter MetricKind = iota
+
+	// Gauge is a metric whose values rise and fall.
+	Gauge
+
+	// Constant is a metric whose values never change.
+	Constant
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Constant:
+		return "constant"
+	}
+	return "unknown"
+}
+
+// defaultResetTolerance is the default value of ClassifyOptions.ResetTolerance.
+const defaultResetTolerance = 0.1
+
+// ClassifyOptions configures the classification performed by
+// Chunk.ClassifyWith.
+type ClassifyOptions struct {
+	// ResetTolerance is the fraction of its preceding value to which a
+	// metric's value must drop for the decrease to be taken as a counter
+	// reset, such as from a server restart. If zero, the default of 0.1 is
+	// used, and if negative, no decrease is taken as a reset.
+	ResetTolerance float64
+}
+
+func (opts ClassifyOptions) resetTolerance() float64 {
+	if opts.ResetTolerance != 0 {
+		return opts.ResetTolerance
+	}
+	return defaultResetTolerance
+}
+
+// Classify returns the kind of each metric of the chunk, keyed by metric key.
+// A metric is a Constant if its values never change, a Counter if they never
+// decrease apart from at most one reset, and a Gauge otherwise. A reset is a
+// drop to at most a tenth of the preceding value.
+func (c *Chunk) Classify() map[string]MetricKind {
+	return c.ClassifyWith(ClassifyOptions{})
+}
+
+// ClassifyWith is like Classify, but detects resets as configured by opts.
+func (c *Chunk) ClassifyWith(opts ClassifyOptions) map[string]MetricKind {
+	kinds := make(map[string]MetricKind, len(c.Metrics))
+	for _, m := range c.Metrics {
+		kinds[m.Key] = classifyMetric(m, opts.resetTolerance())
+	}
+	return kinds
+}
+
+func classifyMetric(m Metric, tolerance float64) MetricKind {
+	kind := Constant
+	resets := 0
+	v := m.Value
+	for _, d := range m.Deltas {
+		prev := v
+		v += d
+		switch {
+		case d > 0:
+			kind = Counter
+		case d < 0:
+			if tolerance < 0 || resets > 0 || float64(v) > tolerance*float64(prev) {
+				return Gauge
+			}
+			resets++
+			kind = Counter
+		}
+	}
+	return kind
+}
@@ -0,0 +1,83 @@
+package ftdc
+
+import "os"
+
+// MappedFTDC is an FTDC diagnostic file mapped into memory by OpenMapped.
+// Its chunks are decoded directly from the mapped pages, so reading a large
+// file does not copy it onto the heap, and each chunk is only decompressed
+// when it is reached.
+type MappedFTDC struct {
+	data  []byte
+	unmap func([]byte) error
+}
+
+// releaseInterval is the number of bytes of the mapping read by
+// MappedFTDC.Chunks between releases of the pages already read.
+const releaseInterval = 64 << 20
+
+// OpenMapped maps the FTDC diagnostic file at path into memory. On platforms
+// without mmap, the file is read into memory instead. The file must not be
+// modified while it is mapped, and Close must be called to unmap it.
+func OpenMapped(path string) (*MappedFTDC, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &MappedFTDC{data: []byte{}}
+	if fi.Size() == 0 {
+		return m, nil // an empty mapping is invalid
+	}
+	m.data, m.unmap, err = mapFile(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Len returns the size of the mapped file in bytes.
+func (m *MappedFTDC) Len() int {
+	return len(m.data)
+}
+
+// ChunkReader returns a ChunkReader reading the chunks of the mapped file.
+// The chunks it yields do not refer to the mapping, but metadata documents
+// passed to opts.Metadata do, and must not be used after Close.
+func (m *MappedFTDC) ChunkReader(opts DecodeOptions) *ChunkReader {
+	return &ChunkReader{
+		data:  m.data,
+		opts:  opts,
+		total: int64(len(m.data)),
+	}
+}
+
+// Chunks yields the chunks of the mapped file on the given channel, as
+// Chunks does for a reader. As it reads, the pages of the chunks already read
+// are released, so that a single pass over a large file does not keep it all
+// resident. The channel is closed when there are no more chunks.
+func (m *MappedFTDC) Chunks(c chan<- Chunk) error {
+	defer close(c)
+	cr := m.ChunkReader(DecodeOptions{})
+	var released int64
+	for cr.Next() {
+		c <- cr.Chunk()
+		if cr.offset-released >= releaseInterval {
+			released = releasePages(m.data, cr.offset)
+		}
+	}
+	return cr.Err()
+}
+
+// Close unmaps the file. The MappedFTDC must not be used afterwards.
+func (m *MappedFTDC) Close() error {
+	data, unmap := m.data, m.unmap
+	m.data, m.unmap = nil, nil
+	if unmap == nil {
+		return nil
+	}
+	return unmap(data)
+}
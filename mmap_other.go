@@ -0,0 +1,19 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package ftdc
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of f into memory, for platforms
+// without mmap.
+func mapFile(f *os.File, size int64) ([]byte, func([]byte) error, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(f, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
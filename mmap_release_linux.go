@@ -0,0 +1,18 @@
+package ftdc
+
+import (
+	"os"
+	"syscall"
+)
+
+// releasePages advises the kernel that the pages of data before offset will
+// not be needed soon, so they can be dropped from the process's resident set,
+// and returns the offset up to which pages were released. They are read back
+// from the file if accessed again.
+func releasePages(data []byte, offset int64) int64 {
+	n := offset &^ int64(os.Getpagesize()-1)
+	if n > 0 {
+		syscall.Madvise(data[:n], syscall.MADV_DONTNEED)
+	}
+	return n
+}
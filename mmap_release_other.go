@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ftdc
+
+// releasePages does nothing on platforms other than Linux, where pages of a
+// mapped file are left to the kernel's paging, and files which are not
+// mapped are held on the heap.
+func releasePages(data []byte, offset int64) int64 {
+	return offset
+}
@@ -0,0 +1,105 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package ftdc
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// largeFileEnv names the environment variable giving the path of the large
+// FTDC diagnostic file, such as a multi-GB capture, read by
+// BenchmarkOpenMappedRSS.
+const largeFileEnv = "FTDC_LARGE_FILE"
+
+// rssReaderEnv names the environment variable selecting the reader used by
+// TestRSSHelper, which is run in a child process by BenchmarkOpenMappedRSS.
+const rssReaderEnv = "FTDC_RSS_READER"
+
+// readLargeFile reads every chunk of the file at path with the named reader,
+// "reader" or "mapped", discarding them as a single pass over a large file
+// would.
+func readLargeFile(path, reader string) error {
+	c := make(chan Chunk)
+	errc := make(chan error, 1)
+	go func() {
+		switch reader {
+		case "reader":
+			f, err := os.Open(path)
+			if err != nil {
+				close(c)
+				errc <- err
+				return
+			}
+			defer f.Close()
+			errc <- Chunks(f, c)
+		case "mapped":
+			m, err := OpenMapped(path)
+			if err != nil {
+				close(c)
+				errc <- err
+				return
+			}
+			defer m.Close()
+			errc <- m.Chunks(c)
+		default:
+			close(c)
+			errc <- fmt.Errorf("unknown reader '%s'", reader)
+		}
+	}()
+	drainChunks(c)
+	return <-errc
+}
+
+// TestRSSHelper reads the large file in a child process of
+// BenchmarkOpenMappedRSS, so that the peak RSS of each reader is measured
+// alone. It does nothing when run directly.
+func TestRSSHelper(t *testing.T) {
+	reader := os.Getenv(rssReaderEnv)
+	if reader == "" {
+		return
+	}
+	if err := readLargeFile(os.Getenv(largeFileEnv), reader); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkOpenMappedRSS reports the peak RSS of reading the file named by
+// FTDC_LARGE_FILE through the streaming reader and through OpenMapped, each
+// in a child process. It is skipped unless FTDC_LARGE_FILE is set.
+func BenchmarkOpenMappedRSS(b *testing.B) {
+	path := os.Getenv(largeFileEnv)
+	if path == "" {
+		b.Skipf("%s is not set", largeFileEnv)
+	}
+	// Maxrss is in bytes on darwin, and kilobytes elsewhere
+	unit := int64(1024)
+	if runtime.GOOS == "darwin" {
+		unit = 1
+	}
+	for _, reader := range []string{"reader", "mapped"} {
+		b.Run(reader, func(b *testing.B) {
+			var peak int64
+			for i := 0; i < b.N; i++ {
+				cmd := exec.Command(os.Args[0], "-test.run=^TestRSSHelper$")
+				cmd.Env = append(os.Environ(), rssReaderEnv+"="+reader)
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					b.Fatalf("failed to read '%s': %s\n%s", path, err, out)
+				}
+				ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+				if !ok {
+					b.Skip("peak RSS is not reported on this platform")
+				}
+				if rss := int64(ru.Maxrss) * unit; rss > peak {
+					peak = rss
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-RSS-bytes")
+		})
+	}
+}
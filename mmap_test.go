@@ -0,0 +1,119 @@
+package ftdc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTempFile writes data to a file in a temporary directory and returns
+// its path.
+func writeTempFile(t testing.TB, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "metrics.2020-09-13T12-26-40Z-00000")
+	err := os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenMapped(t *testing.T) {
+	data := encodeChunks(t, EncodeOptions{},
+		testChunk(1600000000000, 300), wideChunk(50), testChunk(1600000300000, 1))
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  bool
+	}{
+		{"empty", nil, false},
+		{"chunks", data, false},
+		{"truncated", data[:len(data)-3], true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := OpenMapped(writeTempFile(t, tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if m.Len() != len(tc.data) {
+				t.Errorf("got length %d, expected %d", m.Len(), len(tc.data))
+			}
+
+			want, rerr := collectChunks(func(c chan<- Chunk) error {
+				return Chunks(bytes.NewReader(tc.data), c)
+			})
+			got, err := collectChunks(m.Chunks)
+			if (err != nil) != tc.err || (rerr != nil) != tc.err {
+				t.Fatalf("got errors %v and %v, expected error: %v", err, rerr, tc.err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %d mapped chunks differing from the %d read by Chunks", len(got), len(want))
+			}
+
+			if err := m.Close(); err != nil {
+				t.Errorf("failed to close: %s", err)
+			}
+			if err := m.Close(); err != nil {
+				t.Errorf("failed to close twice: %s", err)
+			}
+		})
+	}
+}
+
+func TestOpenMappedMissing(t *testing.T) {
+	_, err := OpenMapped(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Error("opened a missing file")
+	}
+}
+
+func BenchmarkOpenMapped(b *testing.B) {
+	var chunks []Chunk
+	for i := 0; i < 8; i++ {
+		chunks = append(chunks, wideChunk(2000))
+	}
+	path := writeTempFile(b, encodeChunks(b, EncodeOptions{}, chunks...))
+	for _, bc := range []struct {
+		name   string
+		chunks func(c chan<- Chunk) error
+	}{
+		{"reader", func(c chan<- Chunk) error {
+			f, err := os.Open(path)
+			if err != nil {
+				close(c)
+				return err
+			}
+			defer f.Close()
+			return Chunks(f, c)
+		}},
+		{"mapped", func(c chan<- Chunk) error {
+			m, err := OpenMapped(path)
+			if err != nil {
+				close(c)
+				return err
+			}
+			defer m.Close()
+			return m.Chunks(c)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// discard the chunks, as a single pass over a large file
+				// would, so that only the cost of reading is measured
+				c := make(chan Chunk)
+				errc := make(chan error, 1)
+				go func() {
+					errc <- bc.chunks(c)
+				}()
+				drainChunks(c)
+				if err := <-errc; err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package ftdc
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of f read-only into memory.
+func mapFile(f *os.File, size int64) ([]byte, func([]byte) error, error) {
+	if int64(int(size)) != size {
+		return nil, nil, fmt.Errorf("file '%s' is too large to map", f.Name())
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to map '%s': %s", f.Name(), err)
+	}
+	return data, syscall.Munmap, nil
+}
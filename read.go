@@ -2,110 +2,632 @@ package ftdc
 
 import (
 	"bufio"
-	"bytes"
-	"compress/zlib"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
-func readDiagnostic(f io.Reader, ch chan<- bson.D, abrt <-chan bool) error {
-	defer close(ch)
-	buf := bufio.NewReader(f)
+// AutoReader returns a reader of the FTDC diagnostic file in r, transparently
+// decompressing it if it is wrapped in gzip.
+func AutoReader(r io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(r)
+	magic, err := buf.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// gzip magic followed by the deflate compression method; as the length
+	// prefix of a BSON document, this would be well over the size of any FTDC
+	// document, so it is not ambiguous.
+	if len(magic) == 3 && magic[0] == 0x1f && magic[1] == 0x8b && magic[2] == 0x08 {
+		return gzip.NewReader(buf)
+	}
+	return buf, nil
+}
+
+// The types of document found in an FTDC diagnostic file. Metadata documents
+// hold host information rather than a schema: each metric chunk embeds its
+// own reference document, from which its metric keys are read, so chunks
+// whose metrics change partway through a file, as after a restart, decode
+// independently of those before them.
+const (
+	typeMetadata         = 0
+	typeMetricChunk      = 1
+	typePeriodicMetadata = 2
+)
+
+// maxDocSize is the largest BSON document mongod writes, the 16MB limit on
+// user documents plus the 16KB it allows internally. Longer documents are
+// only found in corrupt input, and are rejected before being allocated.
+const maxDocSize = 16<<20 + 16<<10
+
+// ErrUnsupportedVersion is the error wrapped by VersionError.
+var ErrUnsupportedVersion = errors.New("unsupported FTDC version")
+
+// VersionError is returned when an FTDC diagnostic file contains a document
+// of a type this package does not understand, typically because it was
+// written by a newer server release.
+type VersionError struct {
+	// Type is the value of the document's type field
+	Type interface{}
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s: unknown document type %v", ErrUnsupportedVersion, e.Type)
+}
+
+// Unwrap returns ErrUnsupportedVersion.
+func (e *VersionError) Unwrap() error {
+	return ErrUnsupportedVersion
+}
+
+// ChunkReader reads metric chunks from an FTDC diagnostic file. Successive
+// calls to Next step through the chunks, which are then available through
+// Chunk. Iteration stops at the end of the input or on the first error, which
+// is reported by Err.
+type ChunkReader struct {
+	buf   *bufio.Reader
+	chunk Chunk
+	err   error
+
+	// data is the input held in memory, which is read in place of buf when
+	// buf is nil.
+	data []byte
+
+	// skip, if set, is consulted before decoding a metric chunk document,
+	// which is skipped if it returns true.
+	skip func(bson.M) bool
+
+	// keep, if set, selects the metrics that are retained in each chunk.
+	keep func(key string) bool
+
+	// lenient causes chunks which fail to decode to be skipped, with the
+	// errors collected in skipped.
+	lenient bool
+	skipped []error
+
+	opts  DecodeOptions
+	total int64
+
+	// offset is the number of bytes of the input consumed, plus the offset
+	// the input started at.
+	offset int64
+
+	// chunkOffset and chunkLength locate the document of the current chunk.
+	chunkOffset int64
+	chunkLength int64
+}
+
+// DecodeOptions configures the decoding performed by NewChunkReaderWith and
+// ChunksWith.
+type DecodeOptions struct {
+	// Progress, if set, is called after each chunk is read with the number
+	// of bytes of the input read so far, and the total size of the input or
+	// -1 if it is not known, such as when reading from a pipe. The size is
+	// known when the input is a regular file or has a Size method, as do
+	// bytes.Reader and strings.Reader.
+	Progress func(bytesRead, totalBytes int64)
+
+	// Strict causes chunks which violate the invariants of the format to
+	// fail to decode, rather than produce a malformed Chunk: the number of
+	// metrics must match that of the reference document, every metric must
+	// have NDeltas deltas, and the sample times must not decrease.
+	Strict bool
+
+	// Parallel decodes the deltas of the metrics of each chunk across up to
+	// GOMAXPROCS goroutines, which speeds up reading chunks with many
+	// metrics. The decoded chunks are identical to those decoded serially.
+	Parallel bool
+
+	// Metadata, if set, is called with each metadata document read, whether
+	// written once at startup, holding the host's 'buildInfo' and 'hostInfo',
+	// or periodically. The documents are otherwise skipped.
+	Metadata func(doc bson.Raw)
+
+	// AllowPartialTail treats input ending partway through a document as
+	// the end of the input rather than an error, so that a file mongod is
+	// still writing, such as 'metrics.interim', can be read up to its last
+	// complete chunk. A document which is complete but fails to decode is
+	// still an error.
+	AllowPartialTail bool
+
+	// Aliases renames metrics as chunks are decoded, mapping key prefixes to
+	// the prefixes that replace them, such as to give metrics which moved
+	// between server versions the same keys. A metric is renamed by the
+	// entry for its longest matching key prefix, and is not renamed if none
+	// match.
+	Aliases map[string]string
+}
+
+// alias returns the key as renamed by opts.Aliases.
+func (opts DecodeOptions) alias(key string) string {
+	if len(opts.Aliases) == 0 {
+		return key
+	}
+	s := strings.Split(key, ".")
+	for i := len(s); i > 0; i-- {
+		if to, ok := opts.Aliases[strings.Join(s[:i], ".")]; ok {
+			return strings.Join(append([]string{to}, s[i:]...), ".")
+		}
+	}
+	return key
+}
+
+// NewChunkReader returns a ChunkReader reading the FTDC diagnostic file from r.
+func NewChunkReader(r io.Reader) *ChunkReader {
+	return NewChunkReaderWith(r, DecodeOptions{})
+}
+
+// NewChunkReaderWith is like NewChunkReader, but decodes as configured by
+// opts.
+func NewChunkReaderWith(r io.Reader, opts DecodeOptions) *ChunkReader {
+	cr := &ChunkReader{
+		buf:   bufio.NewReader(r),
+		opts:  opts,
+		total: -1,
+	}
+	if opts.Progress != nil {
+		cr.total = inputSize(r)
+	}
+	return cr
+}
+
+// inputSize returns the size of r in bytes, or -1 if it is not known.
+func inputSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		return fi.Size()
+	case interface{ Size() int64 }:
+		return v.Size()
+	}
+	return -1
+}
+
+// Next advances to the next chunk, which will then be available through
+// Chunk. It returns false when there are no more chunks, either by reaching
+// the end of the input or an error.
+func (cr *ChunkReader) Next() bool {
+	if cr.err != nil {
+		return false
+	}
 	for {
-		doc, err := readBufBSON(buf)
+		b, err := cr.readDoc()
+		if err == io.ErrUnexpectedEOF && cr.opts.AllowPartialTail {
+			err = io.EOF
+		}
 		if err != nil {
-			if err == io.EOF {
-				err = nil
+			if err != io.EOF {
+				// locate the document which could not be read
+				cr.chunkOffset, cr.chunkLength = cr.offset, 0
+			}
+			cr.err = err
+			return false
+		}
+		cr.chunkOffset = cr.offset
+		cr.chunkLength = int64(len(b))
+		cr.offset += int64(len(b))
+		var doc bson.D
+		err = bson.Unmarshal(b, &doc)
+		if err != nil {
+			cr.err = err
+			return false
+		}
+		m := doc.Map()
+		switch m["type"] {
+		case typeMetadata, typePeriodicMetadata:
+			if cr.opts.Metadata != nil {
+				cr.opts.Metadata(bson.Raw{Kind: 0x03, Data: b})
+			}
+			continue
+		case typeMetricChunk:
+		default:
+			cr.err = &VersionError{Type: m["type"]}
+		}
+		if cr.err == nil {
+			if cr.skip != nil && cr.skip(m) {
+				continue
 			}
-			return err
+			cr.chunk, cr.err = readChunk(m, cr.keep, cr.opts)
+			for i := range cr.chunk.Metrics {
+				cr.chunk.Metrics[i].Key = cr.opts.alias(cr.chunk.Metrics[i].Key)
+			}
+			if cr.err == nil && cr.opts.Strict {
+				cr.err = validateChunk(cr.chunk)
+			}
+		}
+		if cr.err != nil && cr.lenient {
+			cr.skipped = append(cr.skipped, fmt.Errorf("skipped chunk with _id %v: %s", m["_id"], cr.err))
+			cr.err = nil
+			continue
 		}
-		select {
-		case ch <- doc:
-		case <-abrt:
-			return nil
+		if cr.err == nil && cr.opts.Progress != nil {
+			cr.opts.Progress(cr.offset, cr.total)
 		}
+		return cr.err == nil
 	}
 }
 
-func readChunks(ch <-chan bson.D, o chan<- Chunk, abrt <-chan bool) error {
-	defer close(o)
-	for doc := range ch {
-		m := doc.Map()
-		if m["type"] == 1 {
-			zBytes := m["data"].([]byte)[4:]
-			z, err := zlib.NewReader(bytes.NewBuffer(zBytes))
-			if err != nil {
-				return err
+// readDoc returns the next document of the input.
+func (cr *ChunkReader) readDoc() ([]byte, error) {
+	if cr.buf != nil {
+		return readBufRaw(cr.buf)
+	}
+	rest := cr.data[cr.offset:]
+	if len(rest) < 4 {
+		return nil, io.EOF
+	}
+	l := unpackInt(rest[:4])
+	if l < 5 || l > maxDocSize {
+		return nil, fmt.Errorf("invalid document length %d at offset %d", l, cr.offset)
+	}
+	if l > len(rest) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return rest[:l:l], nil
+}
+
+// Chunk returns the most recent chunk read by a call to Next.
+func (cr *ChunkReader) Chunk() Chunk {
+	return cr.chunk
+}
+
+// Offset returns the byte offset in the input of the document following the
+// most recent chunk read by Next. It is a document boundary from which reading
+// can be resumed with ChunksFrom.
+func (cr *ChunkReader) Offset() int64 {
+	return cr.offset
+}
+
+// ChunkOffset returns the byte offset in the input and the length of the
+// document of the most recent chunk read by Next, from which the chunk can be
+// read again with ReadChunkAt.
+func (cr *ChunkReader) ChunkOffset() (offset, length int64) {
+	return cr.chunkOffset, cr.chunkLength
+}
+
+// ReadChunkAt decodes the metric chunk document of the given length at the
+// given byte offset of r, as reported by ChunkReader.ChunkOffset.
+func ReadChunkAt(r io.ReaderAt, offset, length int64) (Chunk, error) {
+	b := make([]byte, length)
+	_, err := r.ReadAt(b, offset)
+	if err != nil {
+		return Chunk{}, err
+	}
+	var doc bson.D
+	err = bson.Unmarshal(b, &doc)
+	if err != nil {
+		return Chunk{}, err
+	}
+	m := doc.Map()
+	if m["type"] != typeMetricChunk {
+		return Chunk{}, fmt.Errorf("document at offset %d is not a metric chunk", offset)
+	}
+	return readChunk(m, nil, DecodeOptions{})
+}
+
+// Err returns the first error encountered by the ChunkReader, if other than
+// io.EOF.
+func (cr *ChunkReader) Err() error {
+	if cr.err == io.EOF {
+		return nil
+	}
+	return cr.err
+}
+
+// readChunk decodes a metric chunk document. If keep is non-nil, only
+// metrics for which it returns true are retained in the chunk; the deltas of
+// other metrics are skipped over. If opts.Strict is set, a mismatch between
+// the number of metrics in the header and the reference document is an error
+// rather than a warning.
+func readChunk(m bson.M, keep func(key string) bool, opts DecodeOptions) (c Chunk, err error) {
+	defer func() {
+		// the chunk ended early; io.EOF would read as the end of the input
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	buf, err := openChunk(m)
+	if err != nil {
+		return
+	}
+	metrics, ref, err := readBufMetrics(buf)
+	if err != nil {
+		return
+	}
+	bl := make([]byte, 8)
+	_, err = io.ReadAtLeast(buf, bl, 8)
+	if err != nil {
+		return
+	}
+	nmetrics := unpackInt(bl[:4])
+	ndeltas := unpackInt(bl[4:])
+	if nmetrics != len(metrics) && opts.Strict {
+		err = fmt.Errorf("metrics mismatch: expected %d, got %d", nmetrics, len(metrics))
+		return
+	}
+	if nmetrics != len(metrics) {
+		fmt.Fprintf(os.Stderr, "Warning: metrics mismatch. Expected %d, got %d\n", nmetrics, len(metrics))
+	}
+	if opts.Parallel {
+		var data []byte
+		data, err = ioutil.ReadAll(buf)
+		if err != nil {
+			return
+		}
+		var kept []Metric
+		kept, err = readDeltasParallel(data, metrics, ndeltas, keep)
+		c = Chunk{
+			Metrics:   kept,
+			NDeltas:   ndeltas,
+			reference: ref,
+		}
+		return
+	}
+	var nzeroes int64
+	kept := metrics[:0]
+	for _, metric := range metrics {
+		retain := keep == nil || keep(metric.Key)
+		if retain {
+			metric.Deltas = make([]int64, ndeltas)
+		}
+		for j := 0; j < ndeltas; j++ {
+			var delta int64
+			if nzeroes != 0 {
+				delta = 0
+				nzeroes--
+			} else {
+				delta, err = unpackDelta(buf)
+				if err != nil {
+					return
+				}
+				if delta == 0 {
+					nzeroes, err = unpackDelta(buf)
+					if err != nil {
+						return
+					}
+				}
 			}
-			buf := bufio.NewReader(z)
-			metrics, err := readBufMetrics(buf)
-			if err != nil {
-				return err
+			if retain {
+				metric.Deltas[j] = delta
+			}
+		}
+		if retain {
+			kept = append(kept, metric)
+		}
+	}
+	c = Chunk{
+		Metrics:   kept,
+		NDeltas:   ndeltas,
+		reference: ref,
+	}
+	return
+}
+
+// readDeltasParallel decodes the deltas of metrics from data, the remainder
+// of a metric chunk following its header. As a run of zero deltas can span
+// metrics, data is first scanned for the offset at which the deltas of each
+// metric start and the number of zeroes pending at that offset, then the
+// deltas of the retained metrics are decoded concurrently.
+func readDeltasParallel(data []byte, metrics []Metric, ndeltas int, keep func(key string) bool) ([]Metric, error) {
+	type start struct {
+		offset  int
+		nzeroes int64
+	}
+	starts := make([]start, len(metrics))
+	var p int
+	var nzeroes int64
+	for i := range metrics {
+		starts[i] = start{p, nzeroes}
+		for j := 0; j < ndeltas; j++ {
+			if nzeroes != 0 {
+				nzeroes--
+				continue
 			}
-			bl := make([]byte, 8)
-			_, err = io.ReadAtLeast(buf, bl, 8)
+			q, zero, err := skipDelta(data, p)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			nmetrics := unpackInt(bl[:4])
-			ndeltas := unpackInt(bl[4:])
-			if nmetrics != len(metrics) {
-				fmt.Fprintf(os.Stderr, "Warning: metrics mismatch. Expected %d, got %d\n", nmetrics, len(metrics))
+			p = q
+			if zero {
+				nzeroes, p, err = decodeDelta(data, p)
+				if err != nil {
+					return nil, err
+				}
 			}
-			nzeroes := 0
-			for i, v := range metrics {
-				metrics[i].Value = v.Value
-				metrics[i].Deltas = make([]int, ndeltas)
-				for j := 0; j < ndeltas; j++ {
-					var delta int
+		}
+	}
+
+	var retained []int
+	for i, metric := range metrics {
+		if keep == nil || keep(metric.Key) {
+			retained = append(retained, i)
+		}
+	}
+	nworkers := runtime.GOMAXPROCS(0)
+	if nworkers > len(retained) {
+		nworkers = len(retained)
+	}
+	next := make(chan int)
+	go func() {
+		for _, i := range retained {
+			next <- i
+		}
+		close(next)
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				deltas := make([]int64, ndeltas)
+				p, nzeroes := starts[i].offset, starts[i].nzeroes
+				for j := range deltas {
 					if nzeroes != 0 {
-						delta = 0
 						nzeroes--
-					} else {
-						delta, err = unpackDelta(buf)
-						if err != nil {
-							return err
-						}
-						if delta == 0 {
-							nzeroes, err = unpackDelta(buf)
-							if err != nil {
-								return err
-							}
-						}
+						continue
+					}
+					// the scan above succeeded, so decoding cannot fail
+					deltas[j], p, _ = decodeDelta(data, p)
+					if deltas[j] == 0 {
+						nzeroes, p, _ = decodeDelta(data, p)
 					}
-					metrics[i].Deltas[j] = delta
 				}
+				metrics[i].Deltas = deltas
 			}
-			select {
-			case o <- Chunk{
-				Metrics: metrics,
-				NDeltas: ndeltas,
-			}:
-			case <-abrt:
-				return nil
+		}()
+	}
+	wg.Wait()
+
+	kept := make([]Metric, len(retained))
+	for j, i := range retained {
+		kept[j] = metrics[i]
+	}
+	return kept, nil
+}
+
+// validateChunk checks that every metric of the chunk has NDeltas deltas, and
+// that its sample times do not decrease.
+func validateChunk(c Chunk) error {
+	for _, m := range c.Metrics {
+		if len(m.Deltas) != c.NDeltas {
+			return fmt.Errorf("metric '%s' has %d samples, expected %d",
+				m.Key, len(m.Deltas)+1, c.NDeltas+1)
+		}
+		if m.Key != "start" && m.Key != "serverStatus.start" {
+			continue
+		}
+		for i, d := range m.Deltas {
+			if d < 0 {
+				return fmt.Errorf("metric '%s' decreases at sample %d", m.Key, i+1)
 			}
 		}
 	}
 	return nil
 }
 
+// openChunk returns a reader of the decompressed data of a metric chunk
+// document.
+func openChunk(m bson.M) (*bufio.Reader, error) {
+	data, ok := m["data"].([]byte)
+	if !ok || len(data) < 4 {
+		return nil, fmt.Errorf("missing or invalid chunk data")
+	}
+	z, err := decompressor(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(z), nil
+}
+
+// Validate decodes the whole FTDC diagnostic file read from r, checking the
+// invariants enforced by DecodeOptions.Strict, such as to vet an uploaded
+// file before accepting it. It returns the number of metric chunks and
+// samples decoded, counting no samples for a chunk without metrics, and
+// stops at the first error, which gives the offset of the document that
+// failed.
+func Validate(r io.Reader) (chunks int, samples int, err error) {
+	cr := NewChunkReaderWith(r, DecodeOptions{Strict: true})
+	for cr.Next() {
+		chunks++
+		// a chunk without metrics has no samples, as for Chunk.StatsWith
+		if len(cr.chunk.Metrics) > 0 {
+			samples += cr.chunk.NDeltas + 1
+		}
+	}
+	if err = cr.Err(); err != nil {
+		err = fmt.Errorf("chunk %d at offset %d: %s", chunks, cr.chunkOffset, err)
+	}
+	return
+}
+
+// ReadMetadata returns the metadata documents of the FTDC diagnostic file in
+// r, in the order they appear. Metric chunks are skipped without being
+// decoded.
+func ReadMetadata(r io.Reader) ([]bson.Raw, error) {
+	var docs []bson.Raw
+	cr := NewChunkReaderWith(r, DecodeOptions{
+		Metadata: func(doc bson.Raw) {
+			docs = append(docs, doc)
+		},
+	})
+	cr.skip = func(bson.M) bool { return true }
+	for cr.Next() {
+	}
+	return docs, cr.Err()
+}
+
+// ListMetricKeys returns the sorted metric keys of the first chunk of the
+// FTDC diagnostic file in r. Only the chunk's reference document is decoded.
+func ListMetricKeys(r io.Reader) ([]string, error) {
+	buf := bufio.NewReader(r)
+	for {
+		doc, err := readBufBSON(buf)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := doc.Map()
+		if m["type"] != typeMetricChunk {
+			continue
+		}
+		cbuf, err := openChunk(m)
+		if err != nil {
+			return nil, err
+		}
+		metrics, _, err := readBufMetrics(cbuf)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(metrics))
+		seen := make(map[string]bool, len(metrics))
+		for _, metric := range metrics {
+			if !seen[metric.Key] {
+				seen[metric.Key] = true
+				keys = append(keys, metric.Key)
+			}
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+}
+
 func readBufDoc(buf *bufio.Reader, d interface{}) (err error) {
+	b, err := readBufRaw(buf)
+	if err != nil {
+		return
+	}
+	err = bson.Unmarshal(b, d)
+	return
+}
+
+func readBufRaw(buf *bufio.Reader) (b []byte, err error) {
 	var bl []byte
 	bl, err = buf.Peek(4)
 	if err != nil {
 		return
 	}
 	l := unpackInt(bl)
+	if l < 5 || l > maxDocSize {
+		return nil, fmt.Errorf("invalid document length %d", l)
+	}
 
-	b := make([]byte, l)
+	b = make([]byte, l)
 	_, err = io.ReadAtLeast(buf, b, l)
-	if err != nil {
-		return
-	}
-	err = bson.Unmarshal(b, d)
 	return
 }
 
@@ -114,9 +636,13 @@ func readBufBSON(buf *bufio.Reader) (doc bson.D, err error) {
 	return
 }
 
-func readBufMetrics(buf *bufio.Reader) (metrics []Metric, err error) {
+func readBufMetrics(buf *bufio.Reader) (metrics []Metric, ref []byte, err error) {
+	ref, err = readBufRaw(buf)
+	if err != nil {
+		return
+	}
 	doc := bson.D{}
-	err = readBufDoc(buf, &doc)
+	err = bson.Unmarshal(ref, &doc)
 	if err != nil {
 		return
 	}
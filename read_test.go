@@ -0,0 +1,246 @@
+package ftdc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// wideChunk returns a chunk of 300 samples of nmetrics metrics besides
+// 'start', with random values and deltas, of which a third never change.
+func wideChunk(nmetrics int) Chunk {
+	r := rand.New(rand.NewSource(1))
+	c := testChunk(1600000000000, 300)
+	c.Metrics = c.Metrics[:1]
+	for i := 0; i < nmetrics; i++ {
+		m := Metric{
+			Key:    fmt.Sprintf("serverStatus.m%05d", i),
+			Value:  r.Int63n(1 << 40),
+			Deltas: make([]int64, c.NDeltas),
+		}
+		if i%3 != 0 {
+			for j := range m.Deltas {
+				if r.Intn(4) != 0 {
+					m.Deltas[j] = r.Int63n(1<<20) - 1<<19
+				}
+			}
+		}
+		c.Metrics = append(c.Metrics, m)
+	}
+	return c
+}
+
+func TestDecodeParallel(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks []Chunk
+		opts   DecodeOptions
+	}{
+		{"single sample", []Chunk{testChunk(1600000000000, 1)}, DecodeOptions{}},
+		{"few metrics", []Chunk{testChunk(1600000000000, 300)}, DecodeOptions{}},
+		{"many metrics", []Chunk{wideChunk(3000)}, DecodeOptions{}},
+		{"many chunks", []Chunk{wideChunk(100), testChunk(1600000300000, 10), wideChunk(50)}, DecodeOptions{}},
+		{"strict", []Chunk{wideChunk(3000)}, DecodeOptions{Strict: true}},
+		{"aliases", []Chunk{wideChunk(100)}, DecodeOptions{
+			Aliases: map[string]string{"serverStatus.m00001": "renamed"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeChunks(t, EncodeOptions{}, tc.chunks...)
+			serial := decodeChunksWith(t, data, tc.opts)
+			tc.opts.Parallel = true
+			parallel := decodeChunksWith(t, data, tc.opts)
+			if len(serial) != len(tc.chunks) {
+				t.Fatalf("got %d chunks, expected %d", len(serial), len(tc.chunks))
+			}
+			if !reflect.DeepEqual(parallel, serial) {
+				t.Errorf("chunks decoded in parallel differ from those decoded serially")
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data := encodeChunks(b, EncodeOptions{}, wideChunk(5000))
+	for _, bc := range []struct {
+		name string
+		opts DecodeOptions
+	}{
+		{"serial", DecodeOptions{}},
+		{"parallel", DecodeOptions{Parallel: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				decodeChunksWith(b, data, bc.opts)
+			}
+		})
+	}
+}
+
+// chunkDoc returns an FTDC metric chunk document with the given reference
+// document and the raw metric and delta counts and deltas that follow it,
+// which need not agree with each other.
+func chunkDoc(t testing.TB, ref bson.D, nmetrics, ndeltas int, deltas []int64) []byte {
+	t.Helper()
+	refBytes, err := bson.Marshal(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	raw.Write(refBytes)
+	raw.Write(packInt(nmetrics))
+	raw.Write(packInt(ndeltas))
+	for _, d := range deltas {
+		raw.Write(packDelta(d))
+	}
+	return chunkDocData(t, append(packInt(raw.Len()), compress(t, raw.Bytes())...))
+}
+
+// chunkDocData returns an FTDC metric chunk document with the given data.
+func chunkDocData(t testing.TB, data []byte) []byte {
+	t.Helper()
+	doc, err := bson.Marshal(bson.D{
+		{Name: "_id", Value: msTime(1600000000000)},
+		{Name: "type", Value: 1},
+		{Name: "data", Value: data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func compress(t testing.TB, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	if _, err := z.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	valid := encodeChunks(t, EncodeOptions{}, testChunk(1600000000000, 10), testChunk(1600000010000, 5))
+	first := len(encodeChunks(t, EncodeOptions{}, testChunk(1600000000000, 10)))
+	ref := bson.D{{Name: "start", Value: msTime(1600000000000)}, {Name: "x", Value: 1}}
+	cat := func(docs ...[]byte) []byte {
+		return bytes.Join(docs, nil)
+	}
+	length := func(l uint32) []byte {
+		return []byte{byte(l), byte(l >> 8), byte(l >> 16), byte(l >> 24), 0, 0, 0, 0}
+	}
+	backwards := testChunk(1600000000000, 3)
+	backwards.Metrics[0].Deltas = []int64{1000, -5000}
+
+	for _, tc := range []struct {
+		name            string
+		data            []byte
+		chunks, samples int
+		err             string
+	}{
+		{"empty", nil, 0, 0, ""},
+		{"valid", valid, 2, 15, ""},
+		{"chunk without metrics", encodeChunks(t, EncodeOptions{}, Chunk{}), 1, 0, ""},
+		{"chunk without metrics after samples", cat(valid, encodeChunks(t, EncodeOptions{}, Chunk{})), 3, 15, ""},
+		{"truncated", valid[:len(valid)-3], 1, 10,
+			fmt.Sprintf("chunk 1 at offset %d", first)},
+		{"length too large", cat(valid, length(0xffffffff)), 2, 15, "invalid document length"},
+		{"length beyond maximum", length(1 << 30), 0, 0, "invalid document length"},
+		{"length too small", length(3), 0, 0, "invalid document length"},
+		{"corrupt data", chunkDocData(t, append(packInt(100), 0xde, 0xad, 0xbe, 0xef)), 0, 0, "chunk 0 at offset 0"},
+		{"too many metrics", chunkDoc(t, ref, 3, 1, []int64{1000, 1, 0}), 0, 0, "chunk 0"},
+		{"too few metrics", chunkDoc(t, ref, 1, 1, []int64{1000}), 0, 0, "chunk 0"},
+		{"missing deltas", chunkDoc(t, ref, 2, 4, []int64{1000, 1000}), 0, 0, "chunk 0"},
+		{"decreasing times", encodeChunks(t, EncodeOptions{}, backwards), 0, 0, "chunk 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks, samples, err := Validate(bytes.NewReader(tc.data))
+			if chunks != tc.chunks || samples != tc.samples {
+				t.Errorf("got %d chunks and %d samples, expected %d and %d",
+					chunks, samples, tc.chunks, tc.samples)
+			}
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("got error: %s", err)
+			case tc.err != "" && err == nil:
+				t.Errorf("got no error, expected one containing '%s'", tc.err)
+			case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+				t.Errorf("got error '%s', expected one containing '%s'", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestMissingDeltas(t *testing.T) {
+	ref := bson.D{{Name: "start", Value: msTime(1600000000000)}, {Name: "x", Value: 1}}
+	data := chunkDoc(t, ref, 2, 4, []int64{1000, 1000})
+	for _, parallel := range []bool{false, true} {
+		cr := NewChunkReaderWith(bytes.NewReader(data), DecodeOptions{Parallel: parallel})
+		for cr.Next() {
+			t.Errorf("parallel %v: got a chunk, expected none", parallel)
+		}
+		if err := cr.Err(); err != io.ErrUnexpectedEOF {
+			t.Errorf("parallel %v: got error %v, expected %v", parallel, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestPerChunkReference(t *testing.T) {
+	a := testChunk(1600000000000, 10)
+	b := Chunk{NDeltas: 2, Metrics: []Metric{
+		{Key: "start", Value: 1600000010000, Deltas: []int64{1000, 1000}},
+		{Key: "serverStatus.mem.resident", Value: 512, Deltas: []int64{4, -2}},
+	}}
+	metadata, err := bson.Marshal(bson.D{
+		{Name: "_id", Value: msTime(1600000000000)},
+		{Name: "type", Value: 0},
+		{Name: "doc", Value: bson.D{{Name: "host", Value: "localhost"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := testChunk(1600000020000, 5)
+	data := bytes.Join([][]byte{
+		encodeChunks(t, EncodeOptions{}, a),
+		metadata,
+		encodeChunks(t, EncodeOptions{}, b),
+		encodeChunks(t, EncodeOptions{}, a2),
+	}, nil)
+	want := []Chunk{a, b, a2}
+
+	check := func(t *testing.T, got []Chunk) {
+		if len(got) != len(want) {
+			t.Fatalf("got %d chunks, expected %d", len(got), len(want))
+		}
+		for i := range got {
+			checkSameSamples(t, got[i], want[i])
+		}
+	}
+	t.Run("serial", func(t *testing.T) {
+		check(t, decodeChunks(t, data))
+	})
+	t.Run("parallel", func(t *testing.T) {
+		check(t, decodeChunksWith(t, data, DecodeOptions{Parallel: true}))
+	})
+	t.Run("bytes", func(t *testing.T) {
+		got, err := collectChunks(func(c chan<- Chunk) error {
+			return ChunksBytes(data, c)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, got)
+	})
+}
@@ -0,0 +1,64 @@
+package ftdc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"text/template"
+)
+
+// RenderReport executes tmpl with data, such as a ProximalReport or Stats,
+// and writes the output to w. Nothing is written if the template fails. If
+// tmpl is nil, ReportTextTemplate is used for a ProximalReport and
+// StatsMarkdownTemplate for Stats.
+func RenderReport(w io.Writer, data interface{}, tmpl *template.Template) error {
+	if tmpl == nil {
+		switch data.(type) {
+		case ProximalReport, *ProximalReport:
+			tmpl = ReportTextTemplate
+		case Stats, *Stats:
+			tmpl = StatsMarkdownTemplate
+		default:
+			return fmt.Errorf("no default template for %T", data)
+		}
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// ReportTextTemplate renders a ProximalReport as a plain text summary: its
+// score and severity, followed by the error message of each metric which was
+// not within the threshold.
+var ReportTextTemplate = template.Must(template.New("report.txt").Parse(
+	`score: {{printf "%.4f" .Score}} ({{.Severity}}{{if not .OK}}, threshold not met{{end}})
+metrics compared: {{len .Scores}}
+{{if .Misses}}misses: {{len .Misses}}
+{{range .Scores}}{{with .Err}}{{.Error}}{{end}}{{end}}{{end}}`))
+
+// ReportMarkdownTemplate renders a ProximalReport as a Markdown summary
+// line followed by a table of the metrics which were not within the
+// threshold, with their averages and variances in each compared Stats and
+// the statistics which missed.
+var ReportMarkdownTemplate = template.Must(template.New("report.md").Parse(
+	`**Score:** {{printf "%.4f" .Score}} ({{.Severity}}){{if .NSamplesMiss}}, sample counts not within threshold{{end}}
+{{if .Misses}}
+| Metric | Avg A | Avg B | Var A | Var B | Missed |
+|---|---:|---:|---:|---:|---|
+{{range .Misses}}| {{.Key}} | {{.A.Avg}} | {{.B.Avg}} | {{.A.Var}} | {{.B.Var}} |
+{{- if .AvgMiss}} avg{{end}}{{if .VarMiss}} spread{{end}}{{if .TailMiss}} tail{{end}} |
+{{end}}{{end}}`))
+
+// StatsMarkdownTemplate renders Stats as a Markdown table with a row per
+// metric, sorted by key.
+var StatsMarkdownTemplate = template.Must(template.New("stats.md").Parse(
+	`{{.NSamples}} samples from {{.Start.UTC.Format "2006-01-02T15:04:05Z07:00"}} to {{.End.UTC.Format "2006-01-02T15:04:05Z07:00"}}
+
+| Metric | Samples | Avg | Var | Mean | StdDev | Min | Max |
+|---|---:|---:|---:|---:|---:|---:|---:|
+{{range $key, $m := .Metrics}}| {{$key}} | {{$m.NSamples}} | {{$m.Avg}} | {{$m.Var}} | {{printf "%.2f" $m.Mean}} | {{printf "%.2f" $m.StdDev}} | {{$m.Min}} | {{$m.Max}} |
+{{end}}`))
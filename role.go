@@ -0,0 +1,73 @@
+package ftdc
+
+import "fmt"
+
+// replica set member states reported by replSetGetStatus.myState
+const (
+	replStatePrimary   = 1
+	replStateSecondary = 2
+	replStateArbiter   = 7
+)
+
+// replOpcounters matches the counters of replicated operations applied.
+var replOpcounters = prefixSet([]string{"serverStatus.opcountersRepl"})
+
+// DetectRole classifies the node which captured the chunks as "primary",
+// "secondary", or "arbiter", from the most recent of its samples which report
+// the role. The role is taken from 'replSetGetStatus.myState', else from the
+// 'serverStatus.repl.ismaster', 'serverStatus.repl.secondary', and
+// 'serverStatus.repl.arbiterOnly' flags. If none are present, a node whose
+// 'serverStatus.opcountersRepl' counters increase is applying replicated
+// operations, and so is a secondary. Otherwise, such as for a standalone
+// node, the role is "unknown". An error is returned if there are no chunks.
+func DetectRole(chunks []Chunk) (string, error) {
+	if len(chunks) == 0 {
+		return "", fmt.Errorf("no chunks to detect the role from")
+	}
+	for i := len(chunks) - 1; i >= 0; i-- {
+		m := chunks[i].Map()
+		if state, ok := m["replSetGetStatus.myState"]; ok {
+			switch lastValue(state) {
+			case replStatePrimary:
+				return "primary", nil
+			case replStateSecondary:
+				return "secondary", nil
+			case replStateArbiter:
+				return "arbiter", nil
+			}
+			return "unknown", nil
+		}
+		ismaster, ok1 := m["serverStatus.repl.ismaster"]
+		secondary, ok2 := m["serverStatus.repl.secondary"]
+		if !ok1 && !ok2 {
+			continue
+		}
+		switch {
+		case ok1 && lastValue(ismaster) != 0:
+			return "primary", nil
+		case ok2 && lastValue(secondary) != 0:
+			return "secondary", nil
+		case lastValue(m["serverStatus.repl.arbiterOnly"]) != 0:
+			return "arbiter", nil
+		}
+		return "unknown", nil
+	}
+	for _, c := range chunks {
+		for _, m := range c.Metrics {
+			if !hasKeyPrefix(m.Key, replOpcounters) {
+				continue
+			}
+			for _, d := range m.Deltas {
+				if d > 0 {
+					return "secondary", nil
+				}
+			}
+		}
+	}
+	return "unknown", nil
+}
+
+// lastValue returns the value of the metric's last sample.
+func lastValue(m Metric) int64 {
+	return m.Value + sum(m.Deltas...)
+}
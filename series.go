@@ -0,0 +1,651 @@
+package ftdc
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// AggFunc selects how samples are aggregated when downsampling.
+type AggFunc int
+
+// The aggregation functions supported by Chunk.Downsample.
+const (
+	AggMax AggFunc = iota
+	AggMin
+	AggMean
+	AggLast
+)
+
+// Downsample aggregates the values of the metric with the given key into
+// buckets of the given interval, aligned to the chunk's first sample. It
+// returns the start time and aggregated value of each bucket containing at
+// least one sample.
+func (c *Chunk) Downsample(key string, interval time.Duration, agg AggFunc) ([]time.Time, []int64, error) {
+	if interval <= 0 {
+		return nil, nil, fmt.Errorf("invalid interval: %s", interval)
+	}
+	if agg < AggMax || agg > AggLast {
+		return nil, nil, fmt.Errorf("unknown aggregation function: %d", agg)
+	}
+	ts, vs, err := c.series(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var times []time.Time
+	var out []int64
+	var bucket []int64
+	var cur int
+	for i, v := range vs {
+		b := int(ts[i].Sub(ts[0]) / interval)
+		if len(bucket) > 0 && b != cur {
+			out = append(out, aggregate(bucket, agg))
+			bucket = bucket[:0]
+		}
+		if len(bucket) == 0 {
+			cur = b
+			times = append(times, ts[0].Add(time.Duration(b)*interval))
+		}
+		bucket = append(bucket, v)
+	}
+	if len(bucket) > 0 {
+		out = append(out, aggregate(bucket, agg))
+	}
+	return times, out, nil
+}
+
+// resample returns a chunk holding the last sample of the chunk within each
+// interval of the given duration, with intervals aligned to the epoch so that
+// chunks of different captures share the same grid. The chunk is returned
+// unchanged if it has no timestamp metric.
+func (c *Chunk) resample(interval time.Duration) Chunk {
+	ts, err := c.Timestamps()
+	if err != nil || interval <= 0 {
+		return *c
+	}
+	var keep []int
+	for i, t := range ts {
+		b := t.UnixNano() / int64(interval)
+		if i+1 < len(ts) && ts[i+1].UnixNano()/int64(interval) == b {
+			continue
+		}
+		keep = append(keep, i)
+	}
+	return c.samples(keep)
+}
+
+// Sample returns a chunk holding n samples of the chunk chosen uniformly at
+// random by reservoir sampling, such as to plot a long capture quickly. The
+// same samples are chosen for every metric, so the series stay aligned with
+// the timestamps, and they are kept in their original order. The choice is
+// determined by seed. If the chunk has at most n samples, it is returned
+// unchanged.
+func (c *Chunk) Sample(n int, seed int64) Chunk {
+	total := c.NDeltas + 1
+	if n >= total {
+		return *c
+	}
+	if n <= 0 {
+		return Chunk{reference: c.reference}
+	}
+	r := rand.New(rand.NewSource(seed))
+	keep := make([]int, n)
+	for i := range keep {
+		keep[i] = i
+	}
+	for i := n; i < total; i++ {
+		if j := r.Intn(i + 1); j < n {
+			keep[j] = i
+		}
+	}
+	sort.Ints(keep)
+	return c.samples(keep)
+}
+
+// samples returns a chunk holding the samples of the chunk at the given
+// increasing indices. Metrics without a sample at the first index are
+// dropped, and others are truncated at their last sample.
+func (c *Chunk) samples(keep []int) Chunk {
+	if len(keep) == 0 {
+		return Chunk{reference: c.reference}
+	}
+	out := Chunk{
+		Metrics:   make([]Metric, 0, len(c.Metrics)),
+		NDeltas:   len(keep) - 1,
+		reference: c.reference,
+	}
+	for _, m := range c.Metrics {
+		vs, _ := c.values(m.Key)
+		if len(vs) <= keep[0] {
+			continue // metric has no samples at the indices
+		}
+		rm := Metric{Key: m.Key, Value: vs[keep[0]]}
+		prev := rm.Value
+		for _, i := range keep[1:] {
+			if i >= len(vs) {
+				break
+			}
+			rm.Deltas = append(rm.Deltas, vs[i]-prev)
+			prev = vs[i]
+		}
+		out.Metrics = append(out.Metrics, rm)
+	}
+	return out
+}
+
+// Rate computes the per-second rate of change of the counter metric with the
+// given key. Each rate is computed between a pair of consecutive samples and
+// is timestamped with the later sample of the pair. Pairs where the counter
+// decreases, as happens when it is reset, or where time does not advance are
+// omitted, leaving a gap in the series.
+func (c *Chunk) Rate(key string) ([]time.Time, []float64, error) {
+	ts, vs, err := c.series(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var times []time.Time
+	var rates []float64
+	for i := 1; i < len(vs); i++ {
+		dv := vs[i] - vs[i-1]
+		dt := ts[i].Sub(ts[i-1]).Seconds()
+		if dv < 0 || dt <= 0 {
+			continue
+		}
+		times = append(times, ts[i])
+		rates = append(rates, float64(dv)/dt)
+	}
+	return times, rates, nil
+}
+
+// DerivedLatency returns the average latency, in microseconds, of the
+// operations of the given category of 'serverStatus.opLatencies', such as
+// "reads", "writes" or "commands", between each pair of consecutive samples:
+// the increase of its cumulative 'latency' divided by that of its 'ops'
+// count. Each latency is timestamped with the later sample of the pair. Pairs
+// in which no operations completed, or where either counter decreases, as
+// happens when it is reset, are omitted, leaving a gap in the series.
+func (c *Chunk) DerivedLatency(category string) ([]time.Time, []float64, error) {
+	prefix := "serverStatus.opLatencies." + category
+	ts, lat, err := c.series(prefix + ".latency")
+	if err != nil {
+		return nil, nil, err
+	}
+	_, ops, err := c.series(prefix + ".ops")
+	if err != nil {
+		return nil, nil, err
+	}
+	var times []time.Time
+	var latencies []float64
+	for i := 1; i < len(ts); i++ {
+		dl := lat[i] - lat[i-1]
+		dops := ops[i] - ops[i-1]
+		if dops <= 0 || dl < 0 {
+			continue
+		}
+		times = append(times, ts[i])
+		latencies = append(latencies, float64(dl)/float64(dops))
+	}
+	return times, latencies, nil
+}
+
+// Correlate returns the Pearson correlation coefficient between the sample
+// values of the metrics with the given keys. It returns an error if either
+// metric is missing, or if either has constant values.
+func (c *Chunk) Correlate(keyA, keyB string) (float64, error) {
+	a, err := c.values(keyA)
+	if err != nil {
+		return 0, err
+	}
+	b, err := c.values(keyB)
+	if err != nil {
+		return 0, err
+	}
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("metrics '%s' and '%s' have different sample counts (%d, %d)",
+			keyA, keyB, len(a), len(b))
+	}
+	var meanA, meanB float64
+	for i := range a {
+		meanA += float64(a[i])
+		meanB += float64(b[i])
+	}
+	meanA /= float64(len(a))
+	meanB /= float64(len(b))
+	var cov, varA, varB float64
+	for i := range a {
+		da := float64(a[i]) - meanA
+		db := float64(b[i]) - meanB
+		cov += da * db
+		varA += da * da
+		varB += db * db
+	}
+	if varA == 0 {
+		return 0, fmt.Errorf("metric '%s' has zero variance", keyA)
+	}
+	if varB == 0 {
+		return 0, fmt.Errorf("metric '%s' has zero variance", keyB)
+	}
+	return cov / math.Sqrt(varA*varB), nil
+}
+
+// HistogramOptions configures the buckets of Chunk.HistogramWith.
+type HistogramOptions struct {
+	// Log spaces the bucket edges geometrically rather than evenly, for
+	// metrics such as latencies whose values span orders of magnitude. The
+	// first edge is the minimum value, and the others are spaced from the
+	// greater of the minimum and 1 up to the maximum. If the maximum is not
+	// above 1, the buckets are spaced evenly.
+	Log bool
+}
+
+// Histogram counts the sample values of the metric with the given key into
+// the given number of equal-width buckets between its minimum and maximum
+// values. It returns the buckets+1 edges of the buckets, and the count of
+// each. Bucket i holds the values v with edges[i] <= v < edges[i+1], except
+// that the last bucket also holds the maximum. As the edges are integers,
+// buckets may be empty when the values span fewer than buckets integers.
+func (c *Chunk) Histogram(key string, buckets int) ([]int64, []int, error) {
+	return c.HistogramWith(key, buckets, HistogramOptions{})
+}
+
+// HistogramWith is like Histogram, but spaces the buckets as configured by
+// opts.
+func (c *Chunk) HistogramWith(key string, buckets int, opts HistogramOptions) ([]int64, []int, error) {
+	if buckets < 1 {
+		return nil, nil, fmt.Errorf("invalid bucket count: %d", buckets)
+	}
+	vs, err := c.values(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	min, max := vs[0], vs[0]
+	for _, v := range vs {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	edges := make([]int64, buckets+1)
+	edges[0] = min
+	edges[buckets] = max
+	lo := math.Max(float64(min), 1)
+	if opts.Log && float64(max) > lo {
+		ratio := float64(max) / lo
+		for i := 1; i < buckets; i++ {
+			edges[i] = int64(math.Round(lo * math.Pow(ratio, float64(i)/float64(buckets))))
+		}
+	} else {
+		width := float64(max-min) / float64(buckets)
+		for i := 1; i < buckets; i++ {
+			edges[i] = min + int64(math.Round(width*float64(i)))
+		}
+	}
+	for i := 1; i < buckets; i++ {
+		// rounding can leave edges out of order when the values span fewer
+		// integers than there are buckets
+		if edges[i] < edges[i-1] {
+			edges[i] = edges[i-1]
+		}
+		if edges[i] > max {
+			edges[i] = max
+		}
+	}
+
+	counts := make([]int, buckets)
+	for _, v := range vs {
+		b := sort.Search(buckets, func(j int) bool { return edges[j+1] > v })
+		if b == buckets {
+			b = buckets - 1
+		}
+		counts[b]++
+	}
+	return edges, counts, nil
+}
+
+// Gap is an interval between consecutive samples which is longer than
+// expected, such as while a node was restarting.
+type Gap struct {
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+}
+
+// DetectGaps returns the intervals between consecutive samples of the
+// time-ordered chunks, within or across chunks, which exceed
+// expectedInterval. Chunks without a timestamp metric are ignored.
+func DetectGaps(chunks []Chunk, expectedInterval time.Duration) []Gap {
+	var gaps []Gap
+	var prev time.Time
+	for i := range chunks {
+		ts, err := chunks[i].Timestamps()
+		if err != nil {
+			continue
+		}
+		for _, t := range ts {
+			if !prev.IsZero() {
+				if d := t.Sub(prev); d > expectedInterval {
+					gaps = append(gaps, Gap{Start: prev, End: t, Duration: d})
+				}
+			}
+			prev = t
+		}
+	}
+	return gaps
+}
+
+// Interval is a span of time, from Start to End inclusive.
+type Interval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// MetricPresence returns the intervals of the time-ordered chunks over which
+// the metric with the given key has samples, such as to see when a feature
+// was enabled during a capture. Each interval runs from the first to the last
+// sample of the metric in a run of consecutive chunks containing it, so it is
+// only broken by chunks lacking the metric; use DetectGaps to find gaps in
+// the capture itself. Chunks without a timestamp metric are skipped.
+func MetricPresence(chunks []Chunk, key string) []Interval {
+	var out []Interval
+	open := false
+	for i := range chunks {
+		c := &chunks[i]
+		ts, err := c.Timestamps()
+		if err != nil {
+			continue
+		}
+		n := c.SampleCount(key)
+		if n > len(ts) {
+			n = len(ts)
+		}
+		if n == 0 {
+			open = false
+			continue
+		}
+		if open {
+			out[len(out)-1].End = ts[n-1]
+		} else {
+			out = append(out, Interval{Start: ts[0], End: ts[n-1]})
+		}
+		// a metric which stops partway through a chunk ends its interval
+		open = n == len(ts)
+	}
+	return out
+}
+
+// FindChunk returns the index of the chunk whose span, from its first to its
+// last sample, covers t, searching the time-ordered chunks by bisection. It
+// returns an error if t is not within any chunk's span, such as when it
+// falls in a gap between chunks, or if a chunk has no timestamp metric.
+func FindChunk(chunks []Chunk, t time.Time) (int, error) {
+	var err error
+	span := func(i int) (start, end time.Time) {
+		ts, terr := chunks[i].Timestamps()
+		if terr != nil {
+			if err == nil {
+				err = fmt.Errorf("chunk %d: %s", i, terr)
+			}
+			return
+		}
+		return ts[0], ts[len(ts)-1]
+	}
+	i := sort.Search(len(chunks), func(i int) bool {
+		_, end := span(i)
+		return !end.Before(t)
+	})
+	if err != nil {
+		return -1, err
+	}
+	if i < len(chunks) {
+		start, _ := span(i)
+		if err != nil {
+			return -1, err
+		}
+		if !start.After(t) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("no chunk covers time %s", t.UTC().Format(time.RFC3339Nano))
+}
+
+func aggregate(l []int64, agg AggFunc) int64 {
+	v := l[0]
+	switch agg {
+	case AggMax:
+		for _, x := range l {
+			if x > v {
+				v = x
+			}
+		}
+	case AggMin:
+		for _, x := range l {
+			if x < v {
+				v = x
+			}
+		}
+	case AggMean:
+		v = sum(l...) / int64(len(l))
+	case AggLast:
+		v = l[len(l)-1]
+	}
+	return v
+}
+
+// values returns the delta-decoded sample values of the metric with the given
+// key.
+func (c *Chunk) values(key string) ([]int64, error) {
+	for _, m := range c.Metrics {
+		if m.Key != key {
+			continue
+		}
+		vs := make([]int64, len(m.Deltas)+1)
+		vs[0] = m.Value
+		for i, d := range m.Deltas {
+			vs[i+1] = vs[i] + d
+		}
+		return vs, nil
+	}
+	return nil, fmt.Errorf("metric '%s' not found", key)
+}
+
+// Timestamps returns the time of each sample in the chunk, decoded from the
+// 'start' metric, or 'serverStatus.start' if the chunk has no 'start' metric.
+func (c *Chunk) Timestamps() ([]time.Time, error) {
+	vs, err := c.values("start")
+	if err != nil {
+		vs, err = c.values("serverStatus.start")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("chunk has no timestamp metric")
+	}
+	ts := make([]time.Time, len(vs))
+	for i, v := range vs {
+		ts[i] = msTime(v)
+	}
+	return ts, nil
+}
+
+// RelativeTimestamps returns the time of each sample in the chunk as an
+// offset from its first sample, such as to overlay plots of captures taken at
+// different times.
+func (c *Chunk) RelativeTimestamps() ([]time.Duration, error) {
+	ts, err := c.Timestamps()
+	if err != nil {
+		return nil, err
+	}
+	return c.RelativeTimestampsFrom(ts[0])
+}
+
+// RelativeTimestampsFrom is like RelativeTimestamps, but returns offsets from
+// the given base time. Passing the Stats.Start of a capture aligns all of its
+// chunks to the start of the capture.
+func (c *Chunk) RelativeTimestampsFrom(base time.Time) ([]time.Duration, error) {
+	ts, err := c.Timestamps()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]time.Duration, len(ts))
+	for i, t := range ts {
+		out[i] = t.Sub(base)
+	}
+	return out, nil
+}
+
+// series returns the sample times and values of the metric with the given
+// key.
+func (c *Chunk) series(key string) ([]time.Time, []int64, error) {
+	ts, err := c.Timestamps()
+	if err != nil {
+		return nil, nil, err
+	}
+	vs, err := c.values(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(vs) != len(ts) {
+		return nil, nil, fmt.Errorf("metric '%s' has %d samples, expected %d", key, len(vs), len(ts))
+	}
+	return ts, vs, nil
+}
+
+// timestampKeys are the metrics holding sample times, which are always kept
+// by ChunksFiltered and MetricSeries, and not summed by SumChunksAligned.
+var timestampKeys = map[string]bool{
+	"start":              true,
+	"end":                true,
+	"serverStatus.start": true,
+	"serverStatus.end":   true,
+}
+
+// nodeSeries indexes the samples of a sequence of chunks by time.
+type nodeSeries struct {
+	times  []int64 // sample times in milliseconds, ascending
+	chunk  []int   // index of each sample's chunk
+	sample []int   // index of each sample within its chunk
+	values []map[string][]int64
+}
+
+func newNodeSeries(chunks []Chunk) (*nodeSeries, error) {
+	ns := &nodeSeries{
+		values: make([]map[string][]int64, len(chunks)),
+	}
+	for i := range chunks {
+		c := &chunks[i]
+		ts, err := c.values("start")
+		if err != nil {
+			return nil, err
+		}
+		ns.values[i] = make(map[string][]int64, len(c.Metrics))
+		for _, m := range c.Metrics {
+			ns.values[i][m.Key], _ = c.values(m.Key)
+		}
+		for j, t := range ts {
+			ns.times = append(ns.times, t)
+			ns.chunk = append(ns.chunk, i)
+			ns.sample = append(ns.sample, j)
+		}
+	}
+	if !sort.SliceIsSorted(ns.times, func(i, j int) bool { return ns.times[i] < ns.times[j] }) {
+		return nil, fmt.Errorf("chunks are not in time order")
+	}
+	return ns, nil
+}
+
+// nearest returns the index of the sample nearest to t, if it is within
+// tolerance milliseconds.
+func (ns *nodeSeries) nearest(t, tolerance int64) (int, bool) {
+	i := searchInt64s(ns.times, t)
+	best := -1
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(ns.times) {
+			continue
+		}
+		if best < 0 || abs(ns.times[j]-t) < abs(ns.times[best]-t) {
+			best = j
+		}
+	}
+	if best < 0 || abs(ns.times[best]-t) > tolerance {
+		return 0, false
+	}
+	return best, true
+}
+
+// SumChunksAligned sums the metrics of several nodes' time-ordered chunks,
+// such as those of replica set members, sample by sample. The first node's
+// samples form the timeline of the result: each is matched with the nearest
+// sample of every other node within tolerance, and samples for which some node
+// has no match are dropped. Timestamp metrics are taken from the first node.
+// The result has the metrics of the first node's chunks; a metric which a
+// node's matching chunk lacks contributes nothing from that node.
+func SumChunksAligned(chunks [][]Chunk, tolerance time.Duration) ([]Chunk, error) {
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	nodes := make([]*nodeSeries, len(chunks))
+	for n := range chunks {
+		ns, err := newNodeSeries(chunks[n])
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %s", n, err)
+		}
+		nodes[n] = ns
+	}
+	tol := int64(tolerance / time.Millisecond)
+
+	var out []Chunk
+	ref := nodes[0]
+	for ci, c := range chunks[0] {
+		sums := make(map[string][]int64, len(c.Metrics))
+		var nsamples int
+	samples:
+		for i, t := range ref.values[ci]["start"] {
+			matches := make([]int, len(nodes))
+			for n := 1; n < len(nodes); n++ {
+				j, ok := nodes[n].nearest(t, tol)
+				if !ok {
+					continue samples
+				}
+				matches[n] = j
+			}
+			for _, m := range c.Metrics {
+				v := ref.values[ci][m.Key][i]
+				if !timestampKeys[m.Key] {
+					for n := 1; n < len(nodes); n++ {
+						ns := nodes[n]
+						j := matches[n]
+						if vs, ok := ns.values[ns.chunk[j]][m.Key]; ok {
+							v += vs[ns.sample[j]]
+						}
+					}
+				}
+				sums[m.Key] = append(sums[m.Key], v)
+			}
+			nsamples++
+		}
+		if nsamples == 0 {
+			continue
+		}
+		sc := Chunk{
+			Metrics: make([]Metric, len(c.Metrics)),
+			NDeltas: nsamples - 1,
+		}
+		for k, m := range c.Metrics {
+			vs := sums[m.Key]
+			sc.Metrics[k] = Metric{
+				Key:    m.Key,
+				Value:  vs[0],
+				Deltas: make([]int64, nsamples-1),
+			}
+			for j := 1; j < nsamples; j++ {
+				sc.Metrics[k].Deltas[j-1] = vs[j] - vs[j-1]
+			}
+		}
+		out = append(out, sc)
+	}
+	return out, nil
+}
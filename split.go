@@ -0,0 +1,100 @@
+package ftdc
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// SplitFile partitions the FTDC diagnostic file at path into separate FTDC
+// files at the given boundaries, which need not be sorted. Partition i holds
+// the samples from boundaries[i-1] until before boundaries[i], with the first
+// and last partitions unbounded, and is written to '<path>.<i>'. Chunks
+// spanning a boundary are split between partitions, and each output chunk
+// keeps the reference document of the chunk it came from. Only partitions
+// holding samples are written, and the paths of the written files are
+// returned in partition order.
+func SplitFile(path string, boundaries []time.Time) ([]string, error) {
+	var bounds []int64
+	for _, b := range boundaries {
+		bounds = append(bounds, b.UnixNano()/int64(time.Millisecond))
+	}
+	sortInt64s(bounds)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type part struct {
+		path string
+		file *os.File
+		w    *ChunkWriter
+	}
+	parts := make([]*part, len(bounds)+1)
+	defer func() {
+		for _, p := range parts {
+			if p != nil && p.file != nil {
+				p.file.Close()
+			}
+		}
+	}()
+
+	write := func(i int, c Chunk) error {
+		p := parts[i]
+		if p == nil {
+			name := fmt.Sprintf("%s.%d", path, i)
+			out, err := os.Create(name)
+			if err != nil {
+				return err
+			}
+			p = &part{path: name, file: out, w: NewChunkWriter(out)}
+			parts[i] = p
+		}
+		return p.w.WriteChunk(c)
+	}
+
+	cr := NewChunkReader(f)
+	for cr.Next() {
+		c := cr.Chunk()
+		ts, err := c.Timestamps()
+		if err != nil {
+			return nil, fmt.Errorf("splitting '%s': %v", path, err)
+		}
+		// samples [start, i) of the chunk belong to partition cur
+		start, cur := 0, -1
+		for i := 0; i <= len(ts); i++ {
+			p := len(bounds)
+			if i < len(ts) {
+				ms := ts[i].UnixNano() / int64(time.Millisecond)
+				p = searchInt64s(bounds, ms+1)
+			}
+			if i > start && (i == len(ts) || p != cur) {
+				err = write(cur, c.slice(start, i))
+				if err != nil {
+					return nil, err
+				}
+				start = i
+			}
+			cur = p
+		}
+	}
+	if err := cr.Err(); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, p := range parts {
+		if p == nil {
+			continue
+		}
+		err := p.file.Close()
+		p.file = nil
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p.path)
+	}
+	return paths, nil
+}
@@ -1,8 +1,13 @@
 package ftdc
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"math"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -11,10 +16,57 @@ import (
 type MetricStat struct {
 	// Avg is the mean of the metric's deltas. It is analogous to the first
 	// derivative.
-	Avg int
+	Avg int64
 
 	// Var is the variance. It is related to the absolute second derivative.
-	Var int
+	Var int64
+
+	// P25, P75, P90, P95, and P99 are percentiles of the metric's deltas,
+	// like Avg and Var, rather than of its sample values, using the
+	// nearest-rank method without interpolation. For a latency counter, a
+	// delta is the latency accumulated over a sample interval. They are only
+	// computed when StatsOptions.Percentiles is set.
+	P25 int64 `json:",omitempty"`
+	P75 int64 `json:",omitempty"`
+	P90 int64 `json:",omitempty"`
+	P95 int64 `json:",omitempty"`
+	P99 int64 `json:",omitempty"`
+
+	// MAD is the median absolute deviation of the metric's deltas from
+	// their median, a measure of spread which is robust to outliers. It is
+	// computed along with the percentiles.
+	MAD int64 `json:",omitempty"`
+
+	// Percentiles is set when the percentile fields and MAD were computed,
+	// so that percentiles of 0, as of a metric whose deltas are mostly 0, can
+	// be told apart from percentiles which were not computed.
+	Percentiles bool `json:",omitempty"`
+
+	// Mean and StdDev are the arithmetic mean and population standard
+	// deviation of the metric's sample values, as opposed to its deltas.
+	Mean   float64
+	StdDev float64
+
+	// Min and Max are the smallest and largest of the metric's sample
+	// values, and Range is the difference between them.
+	Min   int64
+	Max   int64
+	Range int64
+
+	// Outlier is set if Max exceeds Mean by more than StatsOptions.OutlierK
+	// standard deviations, flagging metrics with sharp spikes.
+	Outlier bool
+
+	// NSamples is the number of samples of the metric which are present.
+	// It is less than Stats.NSamples for metrics which appear or disappear
+	// partway through the samples.
+	NSamples int `json:",omitempty"`
+
+	// Values holds the metric's sample values in sample order, such as for
+	// plotting a flagged metric without decoding it again. It is only set
+	// when StatsOptions.KeepValues is set, and MergeStats concatenates the
+	// values of its inputs in the order given.
+	Values []int64 `json:",omitempty"`
 }
 
 // Stats represents basic statistics for a set of metric samples.
@@ -23,42 +75,247 @@ type Stats struct {
 	End      time.Time
 	Metrics  map[string]MetricStat
 	NSamples int
+
+	// deltas holds the sorted deltas of each metric whose percentiles were
+	// computed, from which MergeStats computes those of the merge. It is not
+	// encoded as JSON.
+	deltas map[string][]int64
+}
+
+// statsJSON is the JSON representation of Stats.
+type statsJSON struct {
+	Start    string
+	End      string
+	Metrics  map[string]MetricStat
+	NSamples int
+}
+
+// MarshalJSON encodes the Stats as JSON, with Start and End as RFC3339
+// timestamps in UTC, including fractional seconds. Metrics are encoded in
+// sorted key order.
+func (s Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(statsJSON{
+		Start:    s.Start.UTC().Format(time.RFC3339Nano),
+		End:      s.End.UTC().Format(time.RFC3339Nano),
+		Metrics:  s.Metrics,
+		NSamples: s.NSamples,
+	})
+}
+
+// UnmarshalJSON decodes Stats encoded by MarshalJSON.
+func (s *Stats) UnmarshalJSON(b []byte) error {
+	var sj statsJSON
+	err := json.Unmarshal(b, &sj)
+	if err != nil {
+		return err
+	}
+	start, err := time.Parse(time.RFC3339, sj.Start)
+	if err != nil {
+		return err
+	}
+	end, err := time.Parse(time.RFC3339, sj.End)
+	if err != nil {
+		return err
+	}
+	*s = Stats{
+		Start:    start,
+		End:      end,
+		Metrics:  sj.Metrics,
+		NSamples: sj.NSamples,
+	}
+	return nil
+}
+
+// Subset returns the Stats restricted to the metrics with the given key
+// prefix, matching a key equal to it or any key nested beneath it, or the
+// keys matched by a pattern such as 'serverStatus.*.insert', as
+// CompareOptions.Include and ChunksFiltered do. Start, End, and NSamples are
+// preserved. It returns an error if the pattern is malformed.
+func (s Stats) Subset(prefix string) (Stats, error) {
+	if err := checkKeyPatterns([]string{prefix}); err != nil {
+		return Stats{}, err
+	}
+	out := s
+	out.Metrics = make(map[string]MetricStat)
+	prefixes := prefixSet([]string{prefix})
+	for k, v := range s.Metrics {
+		if hasKeyPrefix(k, prefixes) {
+			out.Metrics[k] = v
+		}
+	}
+	return out, nil
+}
+
+// StatsOptions controls which statistics are computed for each metric.
+type StatsOptions struct {
+	// Percentiles enables computation of the percentile fields and MAD of
+	// MetricStat, which requires sorting each metric's deltas. The set of
+	// percentiles is fixed, and each is of the deltas, or of the rates with
+	// Rates, not of the sample values; the percentiles of the sample values of
+	// a metric can be computed from MetricStat.Values with KeepValues.
+	Percentiles bool
+
+	// OutlierK is the number of standard deviations above the mean beyond
+	// which MetricStat.Outlier is set. If zero, the default of 3 is used.
+	OutlierK float64
+
+	// Transform maps metric key prefixes to functions applied to each of
+	// the metric's sample values before its statistics are computed, such as
+	// to scale bytes to megabytes. A metric uses the entry for its longest
+	// matching key prefix, and is not transformed if none match.
+	Transform map[string]func(int64) int64
+
+	// ResampleTo, if non-zero, resamples each chunk to a grid of the given
+	// interval before its statistics are computed, so that captures taken at
+	// different sample intervals can be compared. The grid is aligned to the
+	// epoch, and each interval is represented by the last sample within it;
+	// intervals without samples are omitted. ResampleTo should be no shorter
+	// than the longest sample interval of the captures being compared.
+	ResampleTo time.Duration
+
+	// Approximate estimates the percentiles and MAD computed by
+	// StatsAccumulator with the P² algorithm, in constant memory per metric,
+	// rather than retaining every delta to compute them exactly. It is
+	// ignored elsewhere, where the deltas are at hand.
+	Approximate bool
+
+	// KeepValues retains each metric's sample values in MetricStat.Values.
+	// It is ignored by StatsAccumulator, which does not retain samples.
+	KeepValues bool
+
+	// Rates computes the statistics of each metric which Chunk.Classify
+	// finds to be a Counter over its per-second rates rather than its
+	// per-sample deltas, so captures with different sample intervals compare
+	// throughput alike. Avg, Var, and the percentiles are then those of the
+	// rates, while Mean, StdDev, Min, and Max describe the counter as rebuilt
+	// from its rates. A counter reset is taken to count from zero. Gauges and
+	// constants are left as they are. Metrics are classified after
+	// Transform is applied.
+	Rates bool
+}
+
+// defaultOutlierK is the default value of StatsOptions.OutlierK.
+const defaultOutlierK = 3
+
+// transformMetric returns m with the values transformed by the entry of
+// opts.Transform matching its key, if any.
+func (opts StatsOptions) transformMetric(m Metric) Metric {
+	if len(opts.Transform) == 0 {
+		return m
+	}
+	var f func(int64) int64
+	s := strings.Split(m.Key, ".")
+	for i := len(s); i > 0 && f == nil; i-- {
+		f = opts.Transform[strings.Join(s[:i], ".")]
+	}
+	if f == nil {
+		return m
+	}
+	out := Metric{
+		Key:    m.Key,
+		Value:  f(m.Value),
+		Deltas: make([]int64, len(m.Deltas)),
+	}
+	v, prev := m.Value, out.Value
+	for i, d := range m.Deltas {
+		v += d
+		tv := f(v)
+		out.Deltas[i] = tv - prev
+		prev = tv
+	}
+	return out
+}
+
+// prepareMetric returns m, a metric of a chunk with the sample times ts, as
+// transformed by opts.Transform and converted to rates by opts.Rates.
+func (opts StatsOptions) prepareMetric(m Metric, ts []time.Time) Metric {
+	m = opts.transformMetric(m)
+	if opts.Rates && len(ts) > 1 && classifyMetric(m, defaultResetTolerance) == Counter {
+		m = rateMetric(m, ts)
+	}
+	return m
+}
+
+// rateMetric returns the counter m, with the sample times ts, with its deltas
+// divided by the seconds between their samples. Deltas whose samples are not
+// a positive time apart are left as they are.
+func rateMetric(m Metric, ts []time.Time) Metric {
+	out := Metric{
+		Key:    m.Key,
+		Value:  m.Value,
+		Deltas: make([]int64, len(m.Deltas)),
+	}
+	v := m.Value
+	for i, d := range m.Deltas {
+		v += d
+		if d < 0 {
+			d = v // reset, counting from zero
+		}
+		dt := 1.0
+		if i+1 < len(ts) {
+			if s := ts[i+1].Sub(ts[i]).Seconds(); s > 0 {
+				dt = s
+			}
+		}
+		out.Deltas[i] = int64(math.Round(float64(d) / dt))
+	}
+	return out
+}
+
+func (opts StatsOptions) outlierK() float64 {
+	if opts.OutlierK != 0 {
+		return opts.OutlierK
+	}
+	return defaultOutlierK
 }
 
 // Stats produces Stats for the Chunk
-func (c *Chunk) Stats() (s Stats) {
-	s.NSamples = 1 + c.NDeltas
+func (c *Chunk) Stats() Stats {
+	return c.StatsWith(StatsOptions{})
+}
+
+// StatsWith produces Stats for the Chunk, computing the statistics selected
+// by opts.
+func (c *Chunk) StatsWith(opts StatsOptions) (s Stats) {
+	if opts.ResampleTo > 0 {
+		rc := c.resample(opts.ResampleTo)
+		c = &rc
+	}
+	// a chunk without metrics, as may be left at a file boundary, has no
+	// samples
+	if len(c.Metrics) > 0 {
+		s.NSamples = 1 + c.NDeltas
+	}
 	s.Metrics = make(map[string]MetricStat)
-	var start, end int
+	ts, err := c.Timestamps()
 	for _, m := range c.Metrics {
-		s.Metrics[m.Key] = computeMetricStat(m)
-		if m.Key == "start" {
-			start = m.Value / 1000
-			end = (m.Value + sum(m.Deltas...)) / 1000
-		}
+		ms, deltas := computeMetricStat(opts.prepareMetric(m, ts), opts)
+		s.Metrics[m.Key] = ms
+		s.keepDeltas(m.Key, deltas)
+	}
+	// the times of the first and last samples actually present
+	if err == nil && len(ts) > 0 {
+		s.Start = ts[0]
+		s.End = ts[len(ts)-1]
 	}
-	s.Start = time.Unix(int64(start), 0)
-	s.End = time.Unix(int64(end), 0)
 	return
 }
 
 // ComputeAllChunkStats takes an FTDC diagnostic file in the form of an
 // io.Reader, and computes statistics for all metrics on each chunk.
 func ComputeStats(r io.Reader) (cs []Stats, err error) {
-	ch := make(chan Chunk)
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go func() {
-		for c := range ch {
-			cs = append(cs, c.Stats())
-		}
-		wg.Done()
-	}()
-	err = Chunks(r, ch)
-	if err != nil {
-		return
+	return ComputeStatsWith(r, StatsOptions{})
+}
+
+// ComputeStatsWith is like ComputeStats, but computes the statistics selected
+// by opts.
+func ComputeStatsWith(r io.Reader, opts StatsOptions) (cs []Stats, err error) {
+	cr := NewChunkReader(r)
+	for cr.Next() {
+		c := cr.Chunk()
+		cs = append(cs, c.StatsWith(opts))
 	}
-	wg.Wait()
+	err = cr.Err()
 	return
 }
 
@@ -66,99 +323,531 @@ func ComputeStats(r io.Reader) (cs []Stats, err error) {
 // io.Reader, and computes statistics for all metrics within the given time
 // frame, clipping chunks to fit.
 func ComputeStatsInterval(r io.Reader, start, end time.Time) (cs []Stats, err error) {
-	ch := make(chan Chunk)
+	return ComputeStatsIntervalWith(r, start, end, StatsOptions{})
+}
+
+// ComputeStatsIntervalWith is like ComputeStatsInterval, but computes the
+// statistics selected by opts.
+func ComputeStatsIntervalWith(r io.Reader, start, end time.Time, opts StatsOptions) (cs []Stats, err error) {
+	cr := NewChunkReader(r)
+	for cr.Next() {
+		c := cr.Chunk()
+		if c.Clip(start, end) {
+			cs = append(cs, c.StatsWith(opts))
+		}
+	}
+	err = cr.Err()
+	return
+}
+
+// ComputeStatsFiles computes statistics for each of the given FTDC diagnostic
+// files, merging the statistics of each file's chunks with MergeStats. The
+// result has one Stats per file, in the same order as paths.
+func ComputeStatsFiles(paths []string) ([]Stats, error) {
+	return ComputeStatsFilesParallel(paths, 1)
+}
+
+// ComputeStatsFilesParallel is like ComputeStatsFiles, but processes up to
+// workers files concurrently. Once a file fails to decode, no further files
+// are started, files in progress are abandoned, and the first error is
+// returned.
+func ComputeStatsFilesParallel(paths []string, workers int) ([]Stats, error) {
+	return computeStatsFiles(context.Background(), paths, workers)
+}
+
+// ComputeStatsFilesContext is like ComputeStatsFiles, but stops decoding once
+// the context is done, which is checked between chunks. It then returns
+// ctx.Err() along with the Stats of the files completed so far; the Stats of
+// the other files are left empty, with no Metrics.
+func ComputeStatsFilesContext(ctx context.Context, paths []string) ([]Stats, error) {
+	return computeStatsFiles(ctx, paths, 1)
+}
+
+func computeStatsFiles(parent context.Context, paths []string, workers int) ([]Stats, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	ss := make([]Stats, len(paths))
+	jobs := make(chan int)
+	errCh := make(chan error, workers)
 	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go func() {
-		for c := range ch {
-			if c.Clip(start, end) {
-				cs = append(cs, c.Stats())
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				s, err := computeFileStats(ctx, paths[i])
+				if err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+				ss[i] = s
 			}
+		}()
+	}
+feed:
+	for i := range paths {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
 		}
-		wg.Done()
-	}()
-	err = Chunks(r, ch)
+	}
+	close(jobs)
+	wg.Wait()
+	close(errCh)
+	if err := parent.Err(); err != nil {
+		return ss, err
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// computeFileStats computes the merged statistics of the chunks in the file
+// at path, stopping early if ctx is done.
+func computeFileStats(ctx context.Context, path string) (s Stats, err error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return
 	}
-	wg.Wait()
+	defer f.Close()
+	var cs []Stats
+	cr := NewChunkReader(f)
+	for cr.Next() {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		c := cr.Chunk()
+		cs = append(cs, c.Stats())
+	}
+	err = cr.Err()
+	if err != nil {
+		err = fmt.Errorf("failed to read '%s': %s", path, err)
+		return
+	}
+	if len(cs) > 0 {
+		s = MergeStats(cs...)
+	}
+	return
+}
+
+// ComputeStatsStream computes statistics over the chunks received from c
+// until it is closed, such as those sent by Chunks, without retaining the
+// chunks. As with MergeStats, deltas are only taken between samples of the
+// same chunk, but the statistics of each metric are computed exactly over
+// its deltas and values across all chunks, which are buffered per metric. It
+// returns an error if no chunks are received.
+func ComputeStatsStream(c <-chan Chunk) (Stats, error) {
+	return ComputeStatsStreamWith(c, StatsOptions{})
+}
+
+// ComputeStatsStreamWith is like ComputeStatsStream, but computes the
+// statistics selected by opts.
+func ComputeStatsStreamWith(c <-chan Chunk, opts StatsOptions) (s Stats, err error) {
+	segs := make(map[string][]Metric)
+	nchunks := 0
+	for chunk := range c {
+		nchunks++
+		if opts.ResampleTo > 0 {
+			chunk = chunk.resample(opts.ResampleTo)
+		}
+		if len(chunk.Metrics) > 0 {
+			s.NSamples += chunk.NDeltas + 1
+		}
+		ts, err := chunk.Timestamps()
+		if err == nil && len(ts) > 0 {
+			if s.Start.IsZero() || ts[0].Before(s.Start) {
+				s.Start = ts[0]
+			}
+			if ts[len(ts)-1].After(s.End) {
+				s.End = ts[len(ts)-1]
+			}
+		}
+		for _, m := range chunk.Metrics {
+			segs[m.Key] = append(segs[m.Key], opts.prepareMetric(m, ts))
+		}
+	}
+	if nchunks == 0 {
+		err = fmt.Errorf("no chunks to compute statistics for")
+		return
+	}
+	s.Metrics = make(map[string]MetricStat, len(segs))
+	for k, l := range segs {
+		ms, deltas := computeSegmentsStat(l, opts)
+		s.Metrics[k] = ms
+		s.keepDeltas(k, deltas)
+	}
 	return
 }
 
-// MergeStats computes a time-weighted merge of Stats.
+// ComputeWindowedStats computes statistics over a window of the given
+// duration, sliding by step across the samples of the chunks. Each window
+// covers [t, t+window), with t starting at the earliest sample. The
+// statistics of each chunk's samples within a window are combined with
+// MergeStats. Windows which contain no samples are omitted, as are chunks
+// without the 'start' timestamp metric.
+func ComputeWindowedStats(chunks []Chunk, window time.Duration, step time.Duration) ([]Stats, error) {
+	if window <= 0 || step <= 0 {
+		return nil, fmt.Errorf("window and step must be positive")
+	}
+	times := make([][]int64, len(chunks))
+	var first, last int64 = math.MaxInt64, math.MinInt64
+	for i := range chunks {
+		ts, err := chunks[i].values("start")
+		if err != nil {
+			continue // never in a window
+		}
+		times[i] = ts
+		if ts[0] < first {
+			first = ts[0]
+		}
+		if ts[len(ts)-1] > last {
+			last = ts[len(ts)-1]
+		}
+	}
+
+	windowMs := int64(window / time.Millisecond)
+	stepMs := int64(step / time.Millisecond)
+	if windowMs == 0 || stepMs == 0 {
+		return nil, fmt.Errorf("window and step must be at least 1ms")
+	}
+	var out []Stats
+	for ws := first; ws <= last; ws += stepMs {
+		we := ws + windowMs
+		var cs []Stats
+		for i := range chunks {
+			ts := times[i]
+			si := searchInt64s(ts, ws)
+			ei := searchInt64s(ts, we)
+			if si >= ei {
+				continue
+			}
+			c := chunks[i].slice(si, ei)
+			cs = append(cs, c.Stats())
+		}
+		if len(cs) > 0 {
+			out = append(out, MergeStats(cs...))
+		}
+	}
+	return out, nil
+}
+
+// MergeStats computes a merge of Stats, weighting each metric by its number
+// of samples present in each input. A metric which is absent from some inputs,
+// such as one which first appears partway through a capture, is treated as
+// having a gap there rather than zero values: its average and variance are
+// those of the deltas between the samples in which it is present, and no
+// delta is computed across a gap. The samples of an input in which a metric
+// has no deltas, such as a single-sample chunk, are counted in its NSamples
+// and sample value statistics, but not in its average and variance. A metric
+// is an Outlier if it is one in any input.
+//
+// The percentiles and MAD of a metric are computed exactly over the deltas of
+// all of the inputs, which are retained by the Stats computed with
+// StatsOptions.Percentiles, as they cannot be derived from those of the
+// inputs. The deltas are not retained through JSON or by an Approximate
+// StatsAccumulator, so for such inputs the percentiles of a metric are only
+// kept if it has deltas in just one of them; otherwise they are left 0, and
+// MetricStat.Percentiles is false.
 func MergeStats(cs ...Stats) (m Stats) {
-	var start int64 = math.MaxInt64
-	var end int64 = math.MinInt64
-	weights := make([]int, len(cs))
-	avgs := make(map[string][]int)
-	vars := make(map[string][]int)
-	for i, s := range cs {
+	stats := make(map[string][]MetricStat)
+	deltas := make(map[string][][]int64)
+	nsamples := make(map[string][]int)
+	for _, s := range cs {
 		m.NSamples += s.NSamples
-		sStart := s.Start.Unix()
-		sEnd := s.End.Unix()
-		if sStart < start {
-			start = sStart
+		if !s.Start.IsZero() && (m.Start.IsZero() || s.Start.Before(m.Start)) {
+			m.Start = s.Start
 		}
-		if sEnd > end {
-			end = sEnd
+		if !s.End.IsZero() && (m.End.IsZero() || s.End.After(m.End)) {
+			m.End = s.End
 		}
-		weights[i] = int(sEnd - sStart)
 		for k, v := range s.Metrics {
-			if _, ok := avgs[k]; !ok {
-				avgs[k] = make([]int, len(cs))
-				vars[k] = make([]int, len(cs))
-			}
-			avgs[k][i] = v.Avg
-			vars[k][i] = v.Var
+			stats[k] = append(stats[k], v)
+			deltas[k] = append(deltas[k], s.deltas[k])
+			nsamples[k] = append(nsamples[k], s.NSamples)
 		}
 	}
-	m.Start = time.Unix(start, 0)
-	m.End = time.Unix(end, 0)
 	m.Metrics = make(map[string]MetricStat)
-	for k := range avgs {
-		avg := weightedAvg(avgs[k], weights)
-		variance := weightedVar(avg, avgs[k], vars[k], weights)
-		m.Metrics[k] = MetricStat{
-			Avg: avg,
-			Var: variance,
-		}
+	for k, l := range stats {
+		ms, merged := mergeMetricStats(l, deltas[k], mergeWeights(l, nsamples[k]))
+		m.Metrics[k] = ms
+		m.keepDeltas(k, merged)
 	}
 	return
 }
 
-func computeMetricStat(m Metric) MetricStat {
-	if len(m.Deltas) == 0 {
-		return MetricStat{-1, -1}
+// keepDeltas retains the sorted deltas of the metric with the given key, if
+// any, for MergeStats.
+func (s *Stats) keepDeltas(key string, deltas []int64) {
+	if deltas == nil {
+		return
+	}
+	if s.deltas == nil {
+		s.deltas = make(map[string][]int64)
+	}
+	s.deltas[key] = deltas
+}
+
+// mergeWeights returns the weight of each of the stats l of a metric in a
+// merge: its number of samples, or, if any of them was computed before
+// NSamples was tracked per metric, the number of samples of each Stats, so
+// that all of the weights are counted alike.
+func mergeWeights(l []MetricStat, nsamples []int) []int {
+	weights := make([]int, len(l))
+	for i, v := range l {
+		if v.NSamples == 0 {
+			copy(weights, nsamples)
+			break
+		}
+		weights[i] = v.NSamples
 	}
-	l := make([]int, len(m.Deltas))
-	copy(l, m.Deltas)
-	avg := sum(l...) / len(l)
-	var variance int
+	return weights
+}
+
+// mergeMetricStats merges the stats l of a metric, with the sorted deltas
+// retained for each of them, if any, and the given weights. The average and
+// variance are only merged from the stats with deltas, but the samples of all
+// of them are counted. The percentiles are computed from the merged deltas,
+// which are returned, if they were retained for all of the stats with deltas.
+func mergeMetricStats(l []MetricStat, deltas [][]int64, weights []int) (MetricStat, []int64) {
+	var avgs, vars []int64
+	var dweights []int
+	var merged []int64
+	retained := true
+	last := -1
+	for i, v := range l {
+		if v.Var < 0 {
+			continue // no deltas
+		}
+		last = i
+		avgs = append(avgs, v.Avg)
+		vars = append(vars, v.Var)
+		dweights = append(dweights, weights[i])
+		merged = append(merged, deltas[i]...)
+		retained = retained && deltas[i] != nil
+	}
+	var mean, variance, W float64
+	for i, v := range l {
+		w := float64(weights[i])
+		mean += w * v.Mean
+		W += w
+	}
+	if W > 0 {
+		mean /= W
+		for i, v := range l {
+			w := float64(weights[i])
+			variance += w * (v.StdDev*v.StdDev + (v.Mean-mean)*(v.Mean-mean))
+		}
+		variance /= W
+	}
+	var n int
+	for _, w := range weights {
+		n += w
+	}
+	min, max := l[0].Min, l[0].Max
+	outlier := false
+	var values []int64
+	for _, v := range l {
+		values = append(values, v.Values...)
+		if v.Min < min {
+			min = v.Min
+		}
+		if v.Max > max {
+			max = v.Max
+		}
+		outlier = outlier || v.Outlier
+	}
+	ms := MetricStat{
+		Avg:      -1,
+		Var:      -1,
+		Mean:     mean,
+		StdDev:   math.Sqrt(variance),
+		Min:      min,
+		Max:      max,
+		Range:    max - min,
+		Outlier:  outlier,
+		NSamples: n,
+		Values:   values,
+	}
+	if len(avgs) > 0 {
+		ms.Avg = weightedAvg(avgs, dweights)
+		ms.Var = weightedVar(ms.Avg, avgs, vars, dweights)
+	}
+	switch {
+	case len(avgs) > 0 && retained:
+		sortInt64s(merged)
+		setPercentiles(&ms, merged)
+		return ms, merged
+	case len(avgs) == 1:
+		v := l[last]
+		ms.P25, ms.P75, ms.P90 = v.P25, v.P75, v.P90
+		ms.P95, ms.P99, ms.MAD = v.P95, v.P99, v.MAD
+		ms.Percentiles = v.Percentiles
+	}
+	return ms, nil
+}
+
+func computeMetricStat(m Metric, opts StatsOptions) (MetricStat, []int64) {
+	return computeSegmentsStat([]Metric{m}, opts)
+}
+
+// computeSegmentsStat computes the statistics of a metric from segments of
+// its samples, such as those of successive chunks. Deltas are only taken
+// between samples of the same segment. If the percentiles are computed, the
+// sorted deltas are returned along with the statistics.
+func computeSegmentsStat(segs []Metric, opts StatsOptions) (MetricStat, []int64) {
+	var l []int64
+	nsamples := 0
+	for _, m := range segs {
+		l = append(l, m.Deltas...)
+		nsamples += len(m.Deltas) + 1
+	}
+	mean, stddev := meanStdDev(segs)
+	var values []int64
+	if opts.KeepValues {
+		values = make([]int64, 0, nsamples)
+	}
+	min, max := segs[0].Value, segs[0].Value
+	for _, m := range segs {
+		v := m.Value
+		for i := -1; i < len(m.Deltas); i++ {
+			if i >= 0 {
+				v += m.Deltas[i]
+			}
+			if opts.KeepValues {
+				values = append(values, v)
+			}
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+	}
+	if len(l) == 0 {
+		return MetricStat{
+			Avg:      -1,
+			Var:      -1,
+			Mean:     mean,
+			StdDev:   stddev,
+			Min:      min,
+			Max:      max,
+			Range:    max - min,
+			NSamples: nsamples,
+			Values:   values,
+		}, nil
+	}
+	avg := sum(l...) / int64(len(l))
+	var variance int64
 	for _, x := range l {
 		variance += square(x - avg)
 	}
-	variance /= len(l)
-	return MetricStat{
-		Avg: avg,
-		Var: variance,
+	variance /= int64(len(l))
+	ms := MetricStat{
+		Avg:      avg,
+		Var:      variance,
+		Mean:     mean,
+		StdDev:   stddev,
+		Min:      min,
+		Max:      max,
+		Range:    max - min,
+		Outlier:  float64(max) > mean+opts.outlierK()*stddev,
+		NSamples: nsamples,
+		Values:   values,
+	}
+	if !opts.Percentiles {
+		return ms, nil
+	}
+	sortInt64s(l)
+	setPercentiles(&ms, l)
+	return ms, l
+}
+
+// setPercentiles sets the percentiles and MAD of ms from the sorted deltas l.
+func setPercentiles(ms *MetricStat, l []int64) {
+	ms.P25 = percentile(l, 25)
+	ms.P75 = percentile(l, 75)
+	ms.P90 = percentile(l, 90)
+	ms.P95 = percentile(l, 95)
+	ms.P99 = percentile(l, 99)
+	ms.MAD = medianAbsDev(l)
+	ms.Percentiles = true
+}
+
+// medianAbsDev returns the median absolute deviation of the sorted slice l
+// from its median, using the nearest-rank method for both medians.
+func medianAbsDev(l []int64) int64 {
+	med := percentile(l, 50)
+	devs := make([]int64, len(l))
+	for i, x := range l {
+		devs[i] = abs(x - med)
+	}
+	sortInt64s(devs)
+	return percentile(devs, 50)
+}
+
+// meanStdDev computes the mean and population standard deviation of the
+// sample values of the metric segments in a single pass using Welford's
+// method, which stays numerically stable for large counter values.
+func meanStdDev(segs []Metric) (mean, stddev float64) {
+	var n, m2 float64
+	for _, m := range segs {
+		v := m.Value
+		for i := -1; i < len(m.Deltas); i++ {
+			if i >= 0 {
+				v += m.Deltas[i]
+			}
+			n++
+			d := float64(v) - mean
+			mean += d / n
+			m2 += d * (float64(v) - mean)
+		}
+	}
+	if n == 0 {
+		return 0, 0
 	}
+	stddev = math.Sqrt(m2 / n)
+	return
 }
 
-func weightedAvg(l, w []int) (v int) {
-	W := 0
+// percentile returns the p-th percentile of the sorted slice l using the
+// nearest-rank method.
+func percentile(l []int64, p float64) int64 {
+	rank := int(math.Ceil(p / 100 * float64(len(l))))
+	if rank < 1 {
+		rank = 1
+	}
+	return l[rank-1]
+}
+
+func weightedAvg(l []int64, w []int) (v int64) {
+	var W int64
 	for i := range w {
-		v += w[i] * l[i]
-		W += w[i]
+		v += int64(w[i]) * l[i]
+		W += int64(w[i])
+	}
+	if W == 0 {
+		return 0
 	}
 	v /= W
 	return
 }
 
-func weightedVar(avg int, avgs, vars, w []int) (v int) {
-	W := 0
+func weightedVar(avg int64, avgs, vars []int64, w []int) (v int64) {
+	var W int64
 	for i := range w {
-		v += w[i] * (vars[i] + square(avgs[i]-avg))
-		W += w[i]
+		v += int64(w[i]) * (vars[i] + square(avgs[i]-avg))
+		W += int64(w[i])
+	}
+	if W == 0 {
+		return 0
 	}
 	v /= W
 	return
@@ -0,0 +1,362 @@
+package ftdc
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestStatsJSONRoundTrip(t *testing.T) {
+	a, b := testChunk(1600000000000, 300), testChunk(1600000300000, 120)
+	for _, tc := range []struct {
+		name  string
+		stats Stats
+	}{
+		{"chunk", a.Stats()},
+		{"percentiles", a.StatsWith(StatsOptions{Percentiles: true})},
+		{"values", b.StatsWith(StatsOptions{KeepValues: true})},
+		{"merged", MergeStats(a.Stats(), b.Stats())},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(tc.stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Stats
+			err = json.Unmarshal(data, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Start.Equal(tc.stats.Start) || !got.End.Equal(tc.stats.End) {
+				t.Errorf("got interval %s to %s, expected %s to %s",
+					got.Start, got.End, tc.stats.Start, tc.stats.End)
+			}
+			if got.NSamples != tc.stats.NSamples {
+				t.Errorf("got %d samples, expected %d", got.NSamples, tc.stats.NSamples)
+			}
+			if !reflect.DeepEqual(got.Metrics, tc.stats.Metrics) {
+				t.Errorf("got metrics %v, expected %v", got.Metrics, tc.stats.Metrics)
+			}
+			score, scores, ok := ProximalWith(tc.stats, got, CompareOptions{
+				Include: []string{"serverStatus"},
+			})
+			if len(scores) != 1+3 {
+				t.Errorf("compared %d scores, expected the sample count and 3 metrics", len(scores))
+			}
+			if score != 1 || !ok {
+				t.Errorf("got score %v (ok: %v), expected 1", score, ok)
+			}
+		})
+	}
+}
+
+func TestStatsStartEnd(t *testing.T) {
+	// chunks of samples a second apart, the second with its header _id a
+	// minute before its first sample
+	a, b := testChunk(1600000000000, 10), testChunk(1600000100000, 10)
+	data := append(encodeChunks(t, EncodeOptions{}, a),
+		withChunkID(t, encodeChunks(t, EncodeOptions{}, b), msTime(1600000040000))...)
+
+	stream := func(cs ...Chunk) (Stats, error) {
+		c := make(chan Chunk, len(cs))
+		for _, chunk := range cs {
+			c <- chunk
+		}
+		close(c)
+		return ComputeStatsStream(c)
+	}
+	merged := func() (Stats, error) {
+		ss, err := ComputeStats(bytes.NewReader(data))
+		return MergeStats(ss...), err
+	}
+	clipped := func() (Stats, error) {
+		ss, err := ComputeStatsInterval(bytes.NewReader(data),
+			msTime(1600000005000), msTime(1600000104000))
+		return MergeStats(ss...), err
+	}
+
+	for _, tc := range []struct {
+		name       string
+		stats      func() (Stats, error)
+		start, end int64
+	}{
+		{"header before first sample", merged, 1600000000000, 1600000109000},
+		{"chunks out of order", func() (Stats, error) { return stream(b, a) }, 1600000000000, 1600000109000},
+		{"clipped", clipped, 1600000005000, 1600000104000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := tc.stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !s.Start.Equal(msTime(tc.start)) || !s.End.Equal(msTime(tc.end)) {
+				t.Errorf("got interval %s to %s, expected %s to %s",
+					s.Start, s.End, msTime(tc.start), msTime(tc.end))
+			}
+		})
+	}
+}
+
+// withChunkID returns the single-chunk FTDC file data with the _id of its
+// chunk replaced by id.
+func withChunkID(t testing.TB, data []byte, id time.Time) []byte {
+	t.Helper()
+	var doc bson.D
+	err := bson.Unmarshal(data, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc[0].Value = id
+	data, err = bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStatsLargeValues(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		value  int64
+		deltas []int64
+	}{
+		{"above 2^31", 1<<31 + 5, []int64{1 << 31, -1, 1 << 32}},
+		{"above 2^53", 1<<53 + 1, []int64{2, 1 << 54, -3}},
+		{"near max", math.MaxInt64 - 10, []int64{3, 3, 3}},
+		{"below -2^31", -1<<31 - 5, []int64{-1 << 31, 1, 7}},
+		{"boolean", 0, []int64{1, 0, -1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Chunk{NDeltas: len(tc.deltas), Metrics: []Metric{
+				{Key: "start", Value: 1600000000000, Deltas: []int64{1000, 1000, 1000}},
+				{Key: "serverStatus.x", Value: tc.value, Deltas: tc.deltas},
+			}}
+			got := decodeChunks(t, encodeChunks(t, EncodeOptions{}, c))
+			checkSameSamples(t, got[0], c)
+
+			values := []int64{tc.value}
+			for _, d := range tc.deltas {
+				values = append(values, values[len(values)-1]+d)
+			}
+			s := got[0].StatsWith(StatsOptions{KeepValues: true, Percentiles: true})
+			ms := s.Metrics["serverStatus.x"]
+			if !reflect.DeepEqual(ms.Values, values) {
+				t.Errorf("got values %v, expected %v", ms.Values, values)
+			}
+			sorted := append([]int64(nil), tc.deltas...)
+			sortInt64s(sorted)
+			if ms.P25 != sorted[0] || ms.P75 != sorted[2] || ms.P99 != sorted[2] {
+				t.Errorf("got percentiles %d, %d, %d of deltas %v",
+					ms.P25, ms.P75, ms.P99, tc.deltas)
+			}
+			min, max := values[0], values[0]
+			for _, v := range values {
+				if v < min {
+					min = v
+				}
+				if v > max {
+					max = v
+				}
+			}
+			if ms.Min != min || ms.Max != max {
+				t.Errorf("got extremes %d and %d, expected %d and %d", ms.Min, ms.Max, min, max)
+			}
+		})
+	}
+}
+
+func TestBooleanReferenceFields(t *testing.T) {
+	ref, err := bson.Marshal(bson.D{
+		{Name: "start", Value: msTime(1600000000000)},
+		{Name: "serverStatus", Value: bson.D{{Name: "ok", Value: true}, {Name: "primary", Value: false}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Chunk{NDeltas: 2, reference: ref, Metrics: []Metric{
+		{Key: "start", Value: 1600000000000, Deltas: []int64{1000, 1000}},
+		{Key: "serverStatus.ok", Value: 1, Deltas: []int64{-1, 1}},
+		{Key: "serverStatus.primary", Value: 0, Deltas: []int64{0, 1}},
+	}}
+	got := decodeChunks(t, encodeChunks(t, EncodeOptions{}, c))
+	checkSameSamples(t, got[0], c)
+	for key, want := range map[string][]int64{
+		"serverStatus.ok":      {1, 0, 1},
+		"serverStatus.primary": {0, 0, 1},
+	} {
+		values := got[0].StatsWith(StatsOptions{KeepValues: true}).Metrics[key].Values
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("metric '%s': got values %v, expected %v", key, values, want)
+		}
+	}
+}
+
+func TestSingleSampleAndEmptyChunks(t *testing.T) {
+	full := testChunk(1600000000000, 10)
+	for _, tc := range []struct {
+		name     string
+		chunk    Chunk
+		nsamples int
+	}{
+		{"single sample", testChunk(1600000000000, 1), 1},
+		{"no metrics", Chunk{}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, opts := range []StatsOptions{
+				{},
+				{Percentiles: true, KeepValues: true, Rates: true},
+			} {
+				s := tc.chunk.StatsWith(opts)
+				if s.NSamples != tc.nsamples {
+					t.Errorf("got %d samples, expected %d", s.NSamples, tc.nsamples)
+				}
+				for key, ms := range s.Metrics {
+					if ms.Avg != -1 || ms.Var != -1 {
+						t.Errorf("metric '%s': got average %d and variance %d without deltas",
+							key, ms.Avg, ms.Var)
+					}
+					if math.IsNaN(ms.Mean) || math.IsNaN(ms.StdDev) {
+						t.Errorf("metric '%s': got mean %v and standard deviation %v",
+							key, ms.Mean, ms.StdDev)
+					}
+				}
+			}
+
+			s := tc.chunk.Stats()
+			score, _, ok := Proximal(s, s)
+			if score != 1 || !ok {
+				t.Errorf("got score %v (ok: %v) against itself, expected 1", score, ok)
+			}
+			r := ProximalDetailedWith(s, full.Stats(), CompareOptions{Tail: true, Spread: CVSpread})
+			if math.IsNaN(r.Score) {
+				t.Errorf("got score %v against a full chunk", r.Score)
+			}
+
+			merged := MergeStats(s, full.Stats())
+			if merged.NSamples != tc.nsamples+10 {
+				t.Errorf("got %d merged samples, expected %d", merged.NSamples, tc.nsamples+10)
+			}
+			sa := NewStatsAccumulator(StatsOptions{Percentiles: true})
+			sa.Add(tc.chunk)
+			if n := sa.Stats().NSamples; n != tc.nsamples {
+				t.Errorf("got %d accumulated samples, expected %d", n, tc.nsamples)
+			}
+
+			_, rates, _ := tc.chunk.Rate("serverStatus.opcounters.insert")
+			if len(rates) != 0 {
+				t.Errorf("got rates %v, expected none", rates)
+			}
+		})
+	}
+}
+
+func TestMergeStatsPercentiles(t *testing.T) {
+	chunk := func(start int64, delta func(i int) int64) Chunk {
+		c := Chunk{NDeltas: 200, Metrics: []Metric{
+			{Key: "start", Value: start, Deltas: make([]int64, 200)},
+			{Key: "serverStatus.x", Deltas: make([]int64, 200)},
+		}}
+		for i := 0; i < 200; i++ {
+			c.Metrics[0].Deltas[i] = 1000
+			c.Metrics[1].Deltas[i] = delta(i)
+		}
+		return c
+	}
+	// a narrow distribution and a wide, offset one
+	a := chunk(1600000000000, func(i int) int64 { return int64(i % 10) })
+	b := chunk(1600000201000, func(i int) int64 { return 500 + int64(i*i%997) })
+	opts := StatsOptions{Percentiles: true}
+
+	c := make(chan Chunk, 2)
+	c <- a
+	c <- b
+	close(c)
+	exact, err := ComputeStatsStreamWith(c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := exact.Metrics["serverStatus.x"]
+	got := MergeStats(a.StatsWith(opts), b.StatsWith(opts)).Metrics["serverStatus.x"]
+	if !got.Percentiles {
+		t.Fatalf("got no percentiles")
+	}
+	if got.P25 != want.P25 || got.P95 != want.P95 || got.P99 != want.P99 || got.MAD != want.MAD {
+		t.Errorf("got P25 %d, P95 %d, P99 %d, and MAD %d, expected %d, %d, %d, and %d",
+			got.P25, got.P95, got.P99, got.MAD, want.P25, want.P95, want.P99, want.MAD)
+	}
+	// merging a merge gives the same percentiles
+	again := MergeStats(MergeStats(a.StatsWith(opts)), b.StatsWith(opts)).Metrics["serverStatus.x"]
+	if again.P95 != want.P95 || again.MAD != want.MAD {
+		t.Errorf("got P95 %d and MAD %d merging a merge, expected %d and %d",
+			again.P95, again.MAD, want.P95, want.MAD)
+	}
+
+	// the deltas are not retained through JSON
+	decoded := func(s Stats) Stats {
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out Stats
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	got = MergeStats(decoded(a.StatsWith(opts)), decoded(b.StatsWith(opts))).Metrics["serverStatus.x"]
+	if got.Percentiles || got.P95 != 0 || got.MAD != 0 {
+		t.Errorf("got P95 %d and MAD %d (percentiles: %v) from decoded Stats, expected none",
+			got.P95, got.MAD, got.Percentiles)
+	}
+	got = MergeStats(decoded(a.StatsWith(opts))).Metrics["serverStatus.x"]
+	if !got.Percentiles || got.P95 != a.StatsWith(opts).Metrics["serverStatus.x"].P95 {
+		t.Errorf("got P95 %d (percentiles: %v) from a single decoded Stats", got.P95, got.Percentiles)
+	}
+}
+
+func TestStatsSubset(t *testing.T) {
+	c := testChunk(1600000000000, 10)
+	s := c.Stats()
+	for _, tc := range []struct {
+		name   string
+		prefix string
+		keys   []string
+		err    bool
+	}{
+		{"exact key", "serverStatus.asserts.regular", []string{"serverStatus.asserts.regular"}, false},
+		{"prefix", "serverStatus.opcounters", []string{"serverStatus.opcounters.insert"}, false},
+		{"pattern", "serverStatus.*.current", []string{"serverStatus.connections.current"}, false},
+		{"pattern of a prefix", "serverStatus.*", []string{
+			"serverStatus.asserts.regular",
+			"serverStatus.connections.current",
+			"serverStatus.opcounters.insert",
+		}, false},
+		{"malformed pattern", "serverStatus.[", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sub, err := s.Subset(tc.prefix)
+			// the same patterns are rejected when filtering chunks
+			ferr := ChunksFiltered(bytes.NewReader(nil), []string{tc.prefix}, make(chan Chunk))
+			if (err != nil) != tc.err || (ferr != nil) != tc.err {
+				t.Fatalf("got error %v, and %v from ChunksFiltered, expected error: %v", err, ferr, tc.err)
+			}
+			var keys []string
+			for k := range sub.Metrics {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tc.keys) {
+				t.Errorf("got keys %v, expected %v", keys, tc.keys)
+			}
+			if err == nil && sub.NSamples != s.NSamples {
+				t.Errorf("got %d samples, expected %d", sub.NSamples, s.NSamples)
+			}
+		})
+	}
+}
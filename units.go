@@ -0,0 +1,80 @@
+package ftdc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Unit is the unit in which a metric is measured, used to format its values.
+type Unit int
+
+// The units supported by MetricStat.HumanValue.
+const (
+	Count Unit = iota
+	Bytes
+	Milliseconds
+)
+
+// UnitFor guesses the unit of the metric with the given key from its name:
+// keys mentioning bytes are in Bytes, keys ending in 'Millis' or 'Ms' are in
+// Milliseconds, and all others are taken to be a Count. Some metrics, such as
+// those under 'serverStatus.mem', which are in megabytes, are not covered by
+// any of these units and are reported as a Count.
+func UnitFor(key string) Unit {
+	name := key[strings.LastIndex(key, ".")+1:]
+	switch {
+	case strings.Contains(strings.ToLower(name), "bytes"):
+		return Bytes
+	case strings.HasSuffix(name, "Millis") || strings.HasSuffix(name, "Ms"):
+		return Milliseconds
+	}
+	return Count
+}
+
+// HumanValue formats the mean of the metric's sample values in the given
+// unit, such as '1.2 GiB' or '340 ms'.
+func (s MetricStat) HumanValue(unit Unit) string {
+	return humanize(s.Mean, unit)
+}
+
+func humanize(v float64, unit Unit) string {
+	neg := ""
+	if v < 0 {
+		neg, v = "-", -v
+	}
+	// the thresholds below are those at which a value would round up to the
+	// next unit, so that 999999 is written as '1.0 M' rather than '1000.0 K'
+	switch unit {
+	case Bytes:
+		if v < 1024 {
+			return fmt.Sprintf("%s%.0f B", neg, v)
+		}
+		return neg + scaled(v, 1024, "iB")
+	case Milliseconds:
+		switch {
+		case v < 999.5:
+			return fmt.Sprintf("%s%.0f ms", neg, v)
+		case v < 59.95*1000:
+			return fmt.Sprintf("%s%.1f s", neg, v/1000)
+		case v < 59.95*60*1000:
+			return fmt.Sprintf("%s%.1f min", neg, v/(60*1000))
+		}
+		return fmt.Sprintf("%s%.1f h", neg, v/(60*60*1000))
+	}
+	if v < 999.5 {
+		return fmt.Sprintf("%s%.0f", neg, v)
+	}
+	return neg + scaled(v, 1000, "")
+}
+
+// scaled formats v, which is at least base, with one decimal in the largest
+// of the prefixes K through E of base for which it is at least 1.
+func scaled(v, base float64, suffix string) string {
+	exp := 1
+	v /= base
+	for v >= 999.95 && exp < 6 {
+		v /= base
+		exp++
+	}
+	return fmt.Sprintf("%.1f %c%s", v, "KMGTPE"[exp-1], suffix)
+}
@@ -4,11 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"io"
+	"sort"
+	"strconv"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
+// flattenBSON returns the numeric values of the document as metrics, in the
+// order mongod encodes them, keyed by their dot-delimited paths. Array
+// elements are keyed by their index, as in 'foo.0.bar', so a metric keeps its
+// key whether it is found in an array or in a subdocument keyed by index.
+// Booleans are 0 or 1, and dates are milliseconds since the epoch. A
+// timestamp is two metrics, as mongod encodes it: its seconds since the epoch
+// keyed by its path, and its increment keyed by its path with '.inc' added.
 func flattenBSON(d bson.D) (o []Metric) {
 	for _, e := range d {
 		switch child := e.Value.(type) {
@@ -20,7 +30,14 @@ func flattenBSON(d bson.D) (o []Metric) {
 					Value: ne.Value,
 				})
 			}
-		case []interface{}: // skip
+		case []interface{}:
+			n := flattenBSON(arrayDoc(child))
+			for _, ne := range n {
+				o = append(o, Metric{
+					Key:   e.Name + "." + ne.Key,
+					Value: ne.Value,
+				})
+			}
 		case string: // skip
 		case bool:
 			if child {
@@ -37,34 +54,52 @@ func flattenBSON(d bson.D) (o []Metric) {
 		case float64:
 			o = append(o, Metric{
 				Key:   e.Name,
-				Value: int(child),
+				Value: int64(child),
 			})
 		case int:
 			o = append(o, Metric{
 				Key:   e.Name,
-				Value: child,
+				Value: int64(child),
 			})
 		case int32:
 			o = append(o, Metric{
 				Key:   e.Name,
-				Value: int(child),
+				Value: int64(child),
 			})
 		case int64:
 			o = append(o, Metric{
 				Key:   e.Name,
-				Value: int(child),
+				Value: child,
 			})
 		case time.Time:
 			o = append(o, Metric{
 				Key:   e.Name,
-				Value: int(child.Unix()) * 1000,
+				Value: child.Unix() * 1000,
+			})
+		case bson.MongoTimestamp:
+			o = append(o, Metric{
+				Key:   e.Name,
+				Value: int64(child) >> 32,
+			}, Metric{
+				Key:   e.Name + ".inc",
+				Value: int64(uint32(child)),
 			})
 		}
 	}
 	return o
 }
 
-func unpackDelta(buf *bufio.Reader) (delta int, err error) {
+// arrayDoc converts an array to a document keyed by element index, as BSON
+// encodes arrays.
+func arrayDoc(a []interface{}) bson.D {
+	d := make(bson.D, len(a))
+	for i, v := range a {
+		d[i] = bson.DocElem{Name: strconv.Itoa(i), Value: v}
+	}
+	return d
+}
+
+func unpackDelta(buf *bufio.Reader) (delta int64, err error) {
 	var res uint64
 	var shift uint
 	for {
@@ -81,13 +116,42 @@ func unpackDelta(buf *bufio.Reader) (delta int, err error) {
 			tmp := make([]byte, 8)
 			binary.LittleEndian.PutUint64(tmp, res)
 			binary.Read(bytes.NewBuffer(tmp), binary.LittleEndian, &n)
-			delta = int(n)
+			delta = n
 			return
 		}
 		shift += 7
 	}
 }
 
+// decodeDelta decodes the varint delta at data[p], as unpackDelta does, and
+// returns it with the offset following it.
+func decodeDelta(data []byte, p int) (delta int64, next int, err error) {
+	var res uint64
+	var shift uint
+	for ; p < len(data); p++ {
+		b := uint64(data[p])
+		res |= (b & 0x7F) << shift
+		if b&0x80 == 0 {
+			return int64(res), p + 1, nil
+		}
+		shift += 7
+	}
+	return 0, p, io.EOF
+}
+
+// skipDelta returns the offset following the varint delta at data[p], and
+// whether the delta is zero, without decoding it.
+func skipDelta(data []byte, p int) (next int, zero bool, err error) {
+	var bits byte
+	for ; p < len(data); p++ {
+		bits |= data[p] & 0x7F
+		if data[p]&0x80 == 0 {
+			return p + 1, bits == 0, nil
+		}
+	}
+	return p, false, io.EOF
+}
+
 func unpackInt(bl []byte) int {
 	return int(int32((uint32(bl[0]) << 0) |
 		(uint32(bl[1]) << 8) |
@@ -95,13 +159,49 @@ func unpackInt(bl []byte) int {
 		(uint32(bl[3]) << 24)))
 }
 
-func sum(l ...int) (s int) {
+func packDelta(delta int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, uint64(delta))
+	return b[:n]
+}
+
+func packInt(n int) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(int32(n)))
+	return b
+}
+
+func sum(l ...int64) (s int64) {
 	for _, v := range l {
 		s += v
 	}
 	return
 }
 
-func square(n int) int {
+func square(n int64) int64 {
 	return n * n
 }
+
+// searchInt64s returns the index of the first element of the sorted slice a
+// which is not less than x, as sort.SearchInts does for ints.
+func searchInt64s(a []int64, x int64) int {
+	return sort.Search(len(a), func(i int) bool { return a[i] >= x })
+}
+
+func sortInt64s(a []int64) {
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// drainChunks receives from chunks until it is closed, so that a goroutine
+// sending on it is not blocked forever after its receiver fails.
+func drainChunks(chunks <-chan Chunk) {
+	for range chunks {
+	}
+}
@@ -0,0 +1,183 @@
+package ftdc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFlattenBSON(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  bson.D
+		want []Metric
+	}{
+		{
+			name: "nested documents",
+			doc: bson.D{
+				{Name: "a", Value: bson.D{{Name: "b", Value: bson.D{{Name: "c", Value: 1}}}}},
+				{Name: "d", Value: 2},
+			},
+			want: []Metric{{Key: "a.b.c", Value: 1}, {Key: "d", Value: 2}},
+		},
+		{
+			name: "array of scalars",
+			doc:  bson.D{{Name: "a", Value: []interface{}{1, 2, 3}}},
+			want: []Metric{{Key: "a.0", Value: 1}, {Key: "a.1", Value: 2}, {Key: "a.2", Value: 3}},
+		},
+		{
+			name: "array of documents",
+			doc: bson.D{{Name: "queryStats", Value: []interface{}{
+				bson.D{{Name: "count", Value: 4}},
+				bson.D{{Name: "count", Value: 5}},
+			}}},
+			want: []Metric{{Key: "queryStats.0.count", Value: 4}, {Key: "queryStats.1.count", Value: 5}},
+		},
+		{
+			name: "document keyed by index",
+			doc: bson.D{{Name: "queryStats", Value: bson.D{
+				{Name: "0", Value: bson.D{{Name: "count", Value: 4}}},
+				{Name: "1", Value: bson.D{{Name: "count", Value: 5}}},
+			}}},
+			want: []Metric{{Key: "queryStats.0.count", Value: 4}, {Key: "queryStats.1.count", Value: 5}},
+		},
+		{
+			name: "nested arrays",
+			doc:  bson.D{{Name: "a", Value: []interface{}{[]interface{}{1}, bson.D{{Name: "b", Value: []interface{}{2}}}}}},
+			want: []Metric{{Key: "a.0.0", Value: 1}, {Key: "a.1.b.0", Value: 2}},
+		},
+		{
+			name: "non-numeric values",
+			doc: bson.D{
+				{Name: "host", Value: "localhost"},
+				{Name: "a", Value: 1},
+				{Name: "empty", Value: []interface{}{}},
+			},
+			want: []Metric{{Key: "a", Value: 1}},
+		},
+		{
+			name: "numeric types",
+			doc: bson.D{
+				{Name: "int32", Value: int32(-7)},
+				{Name: "int64", Value: int64(1) << 40},
+				{Name: "double", Value: 2.9},
+				{Name: "true", Value: true},
+				{Name: "false", Value: false},
+				{Name: "date", Value: time.Unix(1600000000, 0)},
+			},
+			want: []Metric{
+				{Key: "int32", Value: -7},
+				{Key: "int64", Value: 1 << 40},
+				{Key: "double", Value: 2},
+				{Key: "true", Value: 1},
+				{Key: "false", Value: 0},
+				{Key: "date", Value: 1600000000000},
+			},
+		},
+		{
+			name: "timestamp",
+			doc: bson.D{
+				{Name: "optime", Value: bson.MongoTimestamp(1600000000<<32 | 3)},
+				{Name: "after", Value: 1},
+			},
+			want: []Metric{
+				{Key: "optime", Value: 1600000000},
+				{Key: "optime.inc", Value: 3},
+				{Key: "after", Value: 1},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// flatten the document as decoded, as the reader does
+			data, err := bson.Marshal(tc.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var doc bson.D
+			err = bson.Unmarshal(data, &doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := flattenBSON(doc)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, expected %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// fixtureMetrics returns the metrics flattened from the reference document in
+// the extended JSON file testdata/name, keyed by metric key.
+func fixtureMetrics(t testing.TB, name string) map[string]int64 {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	err = bson.UnmarshalJSON(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// decode the document as the reader does
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.D
+	err = bson.Unmarshal(raw, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]int64)
+	for _, m := range flattenBSON(doc) {
+		metrics[m.Key] = m.Value
+	}
+	return metrics
+}
+
+func TestFlattenBSONAcrossVersions(t *testing.T) {
+	v6 := fixtureMetrics(t, "serverStatus-6.0.json")
+	v7 := fixtureMetrics(t, "serverStatus-7.0.json")
+	for _, key := range []string{
+		"start",
+		"serverStatus.localTime",
+		"serverStatus.uptime",
+		"serverStatus.connections.current",
+		"serverStatus.connections.totalCreated",
+		"serverStatus.opcounters.insert",
+		"serverStatus.repl.isWritablePrimary",
+		"serverStatus.repl.lastWrite.opTime.ts",
+		"serverStatus.repl.lastWrite.opTime.ts.inc",
+		"serverStatus.repl.lastWrite.opTime.t",
+		// a document keyed by index in 6.0, and an array in 7.0
+		"serverStatus.metrics.queryStats.0.count",
+		"serverStatus.metrics.queryStats.1.keysExamined",
+		"serverStatus.wiredTiger.cache.bytes currently in the cache",
+	} {
+		a, ok6 := v6[key]
+		b, ok7 := v7[key]
+		if !ok6 || !ok7 {
+			t.Errorf("metric '%s': found in 6.0: %v, in 7.0: %v", key, ok6, ok7)
+			continue
+		}
+		if a != b {
+			t.Errorf("metric '%s': got %d from 6.0 and %d from 7.0", key, a, b)
+		}
+	}
+	// only the metric added in 7.0 differs
+	for key := range v6 {
+		if _, ok := v7[key]; !ok {
+			t.Errorf("metric '%s' of 6.0 not found in 7.0", key)
+		}
+	}
+	for key := range v7 {
+		if _, ok := v6[key]; !ok && key != "serverStatus.connections.rejected" {
+			t.Errorf("metric '%s' of 7.0 not found in 6.0", key)
+		}
+	}
+}
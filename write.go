@@ -0,0 +1,399 @@
+package ftdc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MaxSamplesPerChunk is the default number of samples buffered by
+// ChunkWriter.WriteSample before a chunk is written, matching the default
+// used by mongod.
+const MaxSamplesPerChunk = 300
+
+// ChunkWriter writes metric chunks as an FTDC diagnostic file which can be
+// read back with NewChunkReader or Chunks.
+type ChunkWriter struct {
+	w       io.Writer
+	opts    EncodeOptions
+	keys    []string
+	samples []map[string]int64
+}
+
+// EncodeOptions configures the encoding performed by NewChunkWriterWith.
+type EncodeOptions struct {
+	// Compression is the method used to compress the data of each chunk.
+	// The default, Zlib, is the one used by mongod and understood by all
+	// readers; files compressed with Zstd can only be read by this package
+	// when built with the 'zstd' tag.
+	Compression Compression
+
+	// MaxSamplesPerChunk is the number of samples written per chunk by
+	// WriteSample and WriteChunksWith, such as to match a server's
+	// diagnosticDataCollectionSamplesPerChunk setting. If zero, the package's
+	// MaxSamplesPerChunk is used.
+	MaxSamplesPerChunk int
+}
+
+func (opts EncodeOptions) maxSamples() int {
+	if opts.MaxSamplesPerChunk <= 0 {
+		return MaxSamplesPerChunk
+	}
+	return opts.MaxSamplesPerChunk
+}
+
+// NewChunkWriter returns a ChunkWriter writing an FTDC diagnostic file to w.
+func NewChunkWriter(w io.Writer) *ChunkWriter {
+	return NewChunkWriterWith(w, EncodeOptions{})
+}
+
+// NewChunkWriterWith is like NewChunkWriter, but encodes as configured by
+// opts.
+func NewChunkWriterWith(w io.Writer, opts EncodeOptions) *ChunkWriter {
+	return &ChunkWriter{
+		w:    w,
+		opts: opts,
+	}
+}
+
+// WriteChunk writes the chunk as a single FTDC metric chunk. Any samples
+// buffered by WriteSample are written first. If the chunk was decoded from an
+// FTDC file, its reference document is written back with the values of the
+// chunk's first sample, preserving fields such as strings and dates that are
+// not numeric metrics.
+func (cw *ChunkWriter) WriteChunk(c Chunk) error {
+	err := cw.flush()
+	if err != nil {
+		return err
+	}
+	return writeChunk(cw.w, c, cw.opts)
+}
+
+// WriteSample buffers a single sample, mapping metric keys to values. A chunk
+// is written once EncodeOptions.MaxSamplesPerChunk samples are buffered, or
+// when a sample's set of keys differs from that of the buffered samples.
+func (cw *ChunkWriter) WriteSample(sample map[string]int64) error {
+	keys := make([]string, 0, len(sample))
+	for k := range sample {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if !equalKeys(keys, cw.keys) {
+		err := cw.flush()
+		if err != nil {
+			return err
+		}
+		cw.keys = keys
+	}
+	cw.samples = append(cw.samples, sample)
+	if len(cw.samples) >= cw.opts.maxSamples() {
+		return cw.flush()
+	}
+	return nil
+}
+
+// Close writes any samples buffered by WriteSample. It does not close the
+// underlying writer.
+func (cw *ChunkWriter) Close() error {
+	return cw.flush()
+}
+
+func (cw *ChunkWriter) flush() error {
+	if len(cw.samples) == 0 {
+		return nil
+	}
+	c := Chunk{
+		Metrics: make([]Metric, len(cw.keys)),
+		NDeltas: len(cw.samples) - 1,
+	}
+	for i, k := range cw.keys {
+		m := Metric{
+			Key:    k,
+			Value:  cw.samples[0][k],
+			Deltas: make([]int64, c.NDeltas),
+		}
+		for j := 1; j < len(cw.samples); j++ {
+			m.Deltas[j-1] = cw.samples[j][k] - cw.samples[j-1][k]
+		}
+		c.Metrics[i] = m
+	}
+	cw.samples = cw.samples[:0]
+	return writeChunk(cw.w, c, cw.opts)
+}
+
+// WriteChunks writes the chunks received on chunks as an FTDC diagnostic file
+// until the channel is closed, such as to save the output of a filtering
+// pipeline. Consecutive chunks with the same set of metrics are joined with
+// ConcatChunks and rewritten as chunks of MaxSamplesPerChunk samples; a
+// shorter chunk is only written when the set of metrics changes or the
+// channel is closed. If writing fails, the remaining chunks are received and
+// discarded before the error is returned, so that the sender is not blocked.
+func WriteChunks(w io.Writer, chunks <-chan Chunk) error {
+	return WriteChunksWith(w, chunks, EncodeOptions{})
+}
+
+// WriteChunksWith is like WriteChunks, but encodes as configured by opts.
+func WriteChunksWith(w io.Writer, chunks <-chan Chunk, opts EncodeOptions) error {
+	cw := NewChunkWriterWith(w, opts)
+	limit := opts.maxSamples()
+	var pending []Chunk
+	n := 0
+	// flush writes the pending samples in full chunks, keeping any remainder
+	// pending unless all is set
+	flush := func(all bool) error {
+		if len(pending) == 0 {
+			return nil
+		}
+		c, err := ConcatChunks(pending)
+		if err != nil {
+			return err
+		}
+		pending, n = pending[:0], 0
+		size := c.NDeltas + 1
+		for size > limit {
+			err = cw.WriteChunk(c.slice(0, limit))
+			if err != nil {
+				return err
+			}
+			c = c.slice(limit, size)
+			size -= limit
+		}
+		if all || size == limit {
+			return cw.WriteChunk(c)
+		}
+		pending, n = append(pending, c), size
+		return nil
+	}
+	for c := range chunks {
+		if len(pending) > 0 && !joinable(pending[len(pending)-1], c) {
+			err := flush(true)
+			if err != nil {
+				drainChunks(chunks)
+				return err
+			}
+		}
+		pending = append(pending, c)
+		n += c.NDeltas + 1
+		if n >= limit {
+			err := flush(false)
+			if err != nil {
+				drainChunks(chunks)
+				return err
+			}
+		}
+	}
+	err := flush(true)
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// joinable returns whether ConcatChunks can join b onto a: they must have the
+// same metric keys, and b must start after a ends.
+func joinable(a, b Chunk) bool {
+	if len(a.Metrics) != len(b.Metrics) {
+		return false
+	}
+	keys := make(map[string]bool, len(a.Metrics))
+	for _, m := range a.Metrics {
+		keys[m.Key] = true
+	}
+	for _, m := range b.Metrics {
+		if !keys[m.Key] {
+			return false
+		}
+	}
+	_, end, ok := chunkTimes(a)
+	start, _, bok := chunkTimes(b)
+	return !ok || !bok || start > end
+}
+
+func writeChunk(w io.Writer, c Chunk, opts EncodeOptions) error {
+	ref := referenceDoc(c)
+
+	// encode deltas in the order the reader will flatten the reference
+	// document, which may differ from the order of c.Metrics
+	m := c.Map()
+	order := flattenBSON(ref)
+
+	var raw bytes.Buffer
+	refBytes, err := bson.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	raw.Write(refBytes)
+	raw.Write(packInt(len(order)))
+	raw.Write(packInt(c.NDeltas))
+	var nzeroes int64
+	for _, o := range order {
+		metric := m[o.Key]
+		if len(metric.Deltas) != c.NDeltas {
+			return fmt.Errorf("metric '%s' has %d deltas, expected %d",
+				o.Key, len(metric.Deltas), c.NDeltas)
+		}
+		for _, d := range metric.Deltas {
+			if d == 0 {
+				nzeroes++
+				continue
+			}
+			if nzeroes != 0 {
+				raw.Write(packDelta(0))
+				raw.Write(packDelta(nzeroes - 1))
+				nzeroes = 0
+			}
+			raw.Write(packDelta(d))
+		}
+	}
+	if nzeroes != 0 {
+		raw.Write(packDelta(0))
+		raw.Write(packDelta(nzeroes - 1))
+	}
+
+	var data bytes.Buffer
+	data.Write(packInt(raw.Len()))
+	z, err := compressor(&data, opts.Compression)
+	if err != nil {
+		return err
+	}
+	_, err = z.Write(raw.Bytes())
+	if err != nil {
+		return err
+	}
+	err = z.Close()
+	if err != nil {
+		return err
+	}
+
+	doc := bson.D{
+		{Name: "_id", Value: msTime(m["start"].Value)},
+		{Name: "type", Value: 1},
+		{Name: "data", Value: data.Bytes()},
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// referenceDoc returns the reference document to write for the chunk. If the
+// chunk was decoded from an FTDC file and still has the metrics of its
+// original reference document, in order, that document is reused with its
+// metric values replaced by those of the chunk's first sample, so that
+// non-numeric fields such as strings are preserved. Otherwise, a document is
+// built from the metric keys with unflattenBSON.
+func referenceDoc(c Chunk) bson.D {
+	if c.reference != nil {
+		var d bson.D
+		if bson.Unmarshal(c.reference, &d) == nil {
+			i := 0
+			ref, ok := refillBSON(d, "", c.Metrics, &i)
+			if ok && i == len(c.Metrics) {
+				return ref
+			}
+		}
+	}
+	return unflattenBSON(c.Metrics)
+}
+
+// refillBSON returns a copy of d with the values of the metrics found by
+// flattenBSON replaced by those of metrics, starting at metrics[*i]. It
+// returns false if the metrics of d do not match the keys of metrics.
+func refillBSON(d bson.D, prefix string, metrics []Metric, i *int) (bson.D, bool) {
+	out := make(bson.D, len(d))
+	for j, e := range d {
+		key := prefix + e.Name
+		var v interface{}
+		switch child := e.Value.(type) {
+		case bson.D:
+			sub, ok := refillBSON(child, key+".", metrics, i)
+			if !ok {
+				return nil, false
+			}
+			v = sub
+		case []interface{}:
+			sub, ok := refillBSON(arrayDoc(child), key+".", metrics, i)
+			if !ok {
+				return nil, false
+			}
+			a := make([]interface{}, len(sub))
+			for k := range sub {
+				a[k] = sub[k].Value
+			}
+			v = a
+		case bool, float64, int, int32, int64, time.Time:
+			if *i >= len(metrics) || metrics[*i].Key != key {
+				return nil, false
+			}
+			n := metrics[*i].Value
+			*i++
+			switch child.(type) {
+			case bool:
+				v = n != 0
+			case float64:
+				v = float64(n)
+			case time.Time:
+				v = msTime(n)
+			default:
+				v = n
+			}
+		case bson.MongoTimestamp:
+			if *i+1 >= len(metrics) || metrics[*i].Key != key ||
+				metrics[*i+1].Key != key+".inc" {
+				return nil, false
+			}
+			secs, inc := metrics[*i].Value, metrics[*i+1].Value
+			*i += 2
+			v = bson.MongoTimestamp(secs<<32 | int64(uint32(inc)))
+		default:
+			v = e.Value // not a metric
+		}
+		out[j] = bson.DocElem{Name: e.Name, Value: v}
+	}
+	return out, true
+}
+
+// unflattenBSON builds a reference document from metrics with
+// dot-delimited keys, the inverse of flattenBSON.
+func unflattenBSON(metrics []Metric) bson.D {
+	var root bson.D
+	for _, m := range metrics {
+		root = insertBSON(root, strings.Split(m.Key, "."), m.Value)
+	}
+	return root
+}
+
+func insertBSON(d bson.D, path []string, v int64) bson.D {
+	for i := range d {
+		if d[i].Name != path[0] {
+			continue
+		}
+		if child, ok := d[i].Value.(bson.D); ok && len(path) > 1 {
+			d[i].Value = insertBSON(child, path[1:], v)
+			return d
+		}
+	}
+	if len(path) == 1 {
+		return append(d, bson.DocElem{Name: path[0], Value: v})
+	}
+	return append(d, bson.DocElem{Name: path[0], Value: insertBSON(nil, path[1:], v)})
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
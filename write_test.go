@@ -0,0 +1,189 @@
+package ftdc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestChunkWriterRoundTrip(t *testing.T) {
+	wide := Chunk{NDeltas: 2}
+	for _, key := range []string{"start", "serverStatus.a", "serverStatus.b.c", "end"} {
+		wide.Metrics = append(wide.Metrics, Metric{
+			Key:    key,
+			Value:  1 << 40,
+			Deltas: []int64{-1 << 35, 1 << 35},
+		})
+	}
+
+	for _, tc := range []struct {
+		name   string
+		chunks []Chunk
+	}{
+		{"single sample", []Chunk{testChunk(1600000000000, 1)}},
+		{"one chunk", []Chunk{testChunk(1600000000000, 10)}},
+		{"many chunks", []Chunk{
+			testChunk(1600000000000, 300),
+			testChunk(1600000300000, 300),
+			testChunk(1600000600000, 17),
+		}},
+		{"large and negative deltas", []Chunk{wide}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := decodeChunks(t, encodeChunks(t, EncodeOptions{}, tc.chunks...))
+			if len(got) != len(tc.chunks) {
+				t.Fatalf("got %d chunks, expected %d", len(got), len(tc.chunks))
+			}
+			for i := range got {
+				checkSameSamples(t, got[i], tc.chunks[i])
+			}
+		})
+	}
+}
+
+func TestChunkWriterWriteSample(t *testing.T) {
+	var buf bytes.Buffer
+	cw := NewChunkWriter(&buf)
+	for i := int64(0); i < 700; i++ {
+		err := cw.WriteSample(map[string]int64{"start": 1000 * i, "serverStatus.x": i * i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	for _, c := range decodeChunks(t, buf.Bytes()) {
+		for _, s := range c.Expand(nil) {
+			if s["start"] != 1000*n || s["serverStatus.x"] != n*n {
+				t.Fatalf("sample %d: got %v", n, s)
+			}
+			n++
+		}
+	}
+	if n != 700 {
+		t.Fatalf("got %d samples, expected 700", n)
+	}
+}
+
+func TestChunkWriterRewritesTimestamps(t *testing.T) {
+	ref := bson.D{
+		{Name: "start", Value: msTime(1600000000000)},
+		{Name: "serverStatus", Value: bson.D{
+			{Name: "host", Value: "localhost"},
+			{Name: "optime", Value: bson.MongoTimestamp(1600000000<<32 | 7)},
+			{Name: "ops", Value: int64(3)},
+		}},
+	}
+	raw, err := bson.Marshal(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.D
+	err = bson.Unmarshal(raw, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Chunk{NDeltas: 2, reference: raw}
+	for _, m := range flattenBSON(doc) {
+		m.Deltas = []int64{1, 2}
+		c.Metrics = append(c.Metrics, m)
+	}
+
+	got := decodeChunks(t, encodeChunks(t, EncodeOptions{}, c))
+	if len(got) != 1 {
+		t.Fatalf("got %d chunks, expected 1", len(got))
+	}
+	checkSameSamples(t, got[0], c)
+	rd, err := got[0].Reference()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rd, doc) {
+		t.Errorf("got reference %v, expected %v", rd, doc)
+	}
+}
+
+func TestMaxSamplesPerChunk(t *testing.T) {
+	chunkSizes := func(data []byte) []int {
+		var sizes []int
+		for _, c := range decodeChunks(t, data) {
+			sizes = append(sizes, c.NDeltas+1)
+		}
+		return sizes
+	}
+
+	for _, tc := range []struct {
+		name     string
+		samples  int
+		max      int
+		expected []int
+	}{
+		{"default", 301, 0, []int{300, 1}},
+		{"exact multiple", 9, 3, []int{3, 3, 3}},
+		{"remainder", 10, 3, []int{3, 3, 3, 1}},
+		{"one per chunk", 3, 1, []int{1, 1, 1}},
+		{"fewer than max", 2, 5, []int{2}},
+	} {
+		t.Run("WriteSample/"+tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cw := NewChunkWriterWith(&buf, EncodeOptions{MaxSamplesPerChunk: tc.max})
+			for i := 0; i < tc.samples; i++ {
+				err := cw.WriteSample(map[string]int64{"start": int64(1000 * i)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := chunkSizes(buf.Bytes()); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("got chunks of %v samples, expected %v", got, tc.expected)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		chunks   []int
+		max      int
+		expected []int
+	}{
+		{"joined", []int{2, 2, 2}, 0, []int{6}},
+		{"split", []int{7}, 3, []int{3, 3, 1}},
+		{"joined and split", []int{5, 5}, 4, []int{4, 4, 2}},
+		{"exact", []int{2, 2}, 4, []int{4}},
+	} {
+		t.Run("WriteChunks/"+tc.name, func(t *testing.T) {
+			c := make(chan Chunk, len(tc.chunks))
+			var want []map[string]int64
+			start := int64(1600000000000)
+			for _, n := range tc.chunks {
+				chunk := testChunk(start, n)
+				want = append(want, chunk.Expand(nil)...)
+				c <- chunk
+				start += int64(1000 * n)
+			}
+			close(c)
+			var buf bytes.Buffer
+			err := WriteChunksWith(&buf, c, EncodeOptions{MaxSamplesPerChunk: tc.max})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chunkSizes(buf.Bytes()); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("got chunks of %v samples, expected %v", got, tc.expected)
+			}
+			var got []map[string]int64
+			for _, chunk := range decodeChunks(t, buf.Bytes()) {
+				got = append(got, chunk.Expand(nil)...)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("rewritten samples differ from those written")
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build zstd
+
+package ftdc
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDecoder decodes zstd-compressed chunk data. It is only used through
+// DecodeAll, which is safe for concurrent use.
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+func init() {
+	zstdDecode = func(b []byte) ([]byte, error) {
+		return zstdDecoder.DecodeAll(b, nil)
+	}
+	newZstdWriter = func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build zstd
+
+package ftdc
+
+import "testing"
+
+func TestZstdRoundTrip(t *testing.T) {
+	a, b := testChunk(1600000000000, 300), wideChunk(100)
+	zlibA := encodeChunks(t, EncodeOptions{Compression: Zlib}, a)
+	zstdA := encodeChunks(t, EncodeOptions{Compression: Zstd}, a)
+	zstdB := encodeChunks(t, EncodeOptions{Compression: Zstd}, b)
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		chunks []Chunk
+		opts   DecodeOptions
+	}{
+		{"zstd", zstdA, []Chunk{a}, DecodeOptions{}},
+		{"strict", zstdA, []Chunk{a}, DecodeOptions{Strict: true}},
+		{"parallel", zstdB, []Chunk{b}, DecodeOptions{Parallel: true}},
+		{"mixed", append(append(append([]byte(nil), zlibA...), zstdB...), zlibA...), []Chunk{a, b, a}, DecodeOptions{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := decodeChunksWith(t, tc.data, tc.opts)
+			if len(got) != len(tc.chunks) {
+				t.Fatalf("got %d chunks, expected %d", len(got), len(tc.chunks))
+			}
+			for i := range got {
+				checkSameSamples(t, got[i], tc.chunks[i])
+			}
+		})
+	}
+}